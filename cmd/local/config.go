@@ -9,22 +9,132 @@ import (
     "errors"
     "net/url"
     "strings"
+    "strconv"
+    "time"
+    "sync"
+    "crypto/subtle"
 )
 
 type ServerEndpointConfig struct {
+    // Optional, used by routing rules and listeners to pick the server.
+    Name        string      `json:"name"`
+    // Optional, listeners may use the servers of a group in turn.
+    Group       string      `json:"group"`
     Address     string      `json:"address"`
     Token       string      `json:"token"`
     TokenSecret string      `json:"token_secret"`
     Password   string      `json:"password"`
     Method     string      `json:"method"` // encryption method
+    // Ask the server for the status of connecting to the destination, which
+    // needs a token of at most 14 bytes.
+    //
+    // It requires a server which supports it. An older server never sends the
+    // status, so the client falls back only once the destination sends data,
+    // and the connections of protocols where the client speaks first, such
+    // as HTTP and TLS, fail after the connect timeout.
+    ConnectStatus bool      `json:"connect_status"`
+    // Optional, the name shown to users, which is not unique like Name.
+    DisplayName string      `json:"display_name"`
+    // A SIP003 plugin with its options, and whether the server supports mux
+    // and udp. They are not supported by ssplocal yet, which warns of them
+    // and connects without them, but keeps them in the ssp:// URLs shared
+    // with other clients.
+    Plugin      string      `json:"plugin"`
+    PluginOpts  string      `json:"plugin_opts"`
+    Mux         bool        `json:"mux"`
+    UDP         bool        `json:"udp"`
 
     headerCipher *ss.Cipher
 }
 
+// LocalUserConfig is a user of the socks5 username/password authentication.
+type LocalUserConfig struct {
+    Username    string      `json:"username"`
+    Password    string      `json:"password"`
+    // Optional, the name or address of the server in servers to connect to,
+    // the first server by default.
+    Server      string      `json:"server"`
+    // Optional, the token to connect to the server with, instead of the one
+    // of the server.
+    Token       string      `json:"token"`
+    TokenSecret string      `json:"token_secret"`
+}
+
+// TunnelConfig forwards the connections to Listen to Target through the
+// server, skipping socks.
+type TunnelConfig struct {
+    Listen      string      `json:"listen"`
+    Target      string      `json:"target"`
+    // Optional, the name of the server, the first server by default.
+    Server      string      `json:"server"`
+}
+
+// ListenerConfig is a local listener, which serves one of the protocols:
+// socks5 (also accepts socks4), http, mixed (socks and http), redir or tunnel.
+type ListenerConfig struct {
+    Protocol    string      `json:"protocol"`
+    Address     string      `json:"address"`
+    // redirect or tproxy, for redir listeners.
+    RedirMode   string      `json:"redir_mode"`
+    // The destination of tunnel listeners.
+    Target      string      `json:"target"`
+    // Names of the users allowed, all the users by default. NoAuth disables
+    // authentication on the listener.
+    Users       []string    `json:"users"`
+    NoAuth      bool        `json:"no_auth"`
+    // Optional, the name of the server, or a group of servers used in turn.
+    // Users mapped to servers still use their own.
+    Server      string      `json:"server"`
+    Group       string      `json:"group"`
+}
+
 type Config struct {
+    Listeners   []*ListenerConfig `json:"listeners"`
+    // Shortcuts of the listeners.
     LocalAddr   string      `json:"local_addr"`
+    // Listen address of the http proxy, disabled if empty.
+    HttpAddr    string      `json:"http_addr"`
+    // Also serve http proxy on LocalAddr, by sniffing the protocol.
+    SniffHttp   bool        `json:"sniff_http"`
+
+    // Transparent proxy listen address, disabled if empty. RedirMode is
+    // redirect for iptables REDIRECT by default, or tproxy for TPROXY.
+    RedirAddr   string      `json:"redir_addr"`
+    RedirMode   string      `json:"redir_mode"`
+
+    Tunnels     []*TunnelConfig `json:"tunnels"`
+    // DNS forwarder, disabled if nil.
+    DNS         *DNSConfig  `json:"dns"`
+
+    // Timeouts in seconds, idle timeout of relays is disabled if 0.
+    HandshakeTimeout uint   `json:"handshake_timeout"`
+    ConnectTimeout uint     `json:"connect_timeout"`
+    Timeout uint            `json:"timeout"`
+    // How long a connection lingers after one direction is half-closed.
+    LingerTimeout uint      `json:"linger_timeout"`
 
     Servers []*ServerEndpointConfig `json:"servers"`
+    // Lists of servers fetched periodically, merged into Servers.
+    Subscriptions []*SubscriptionConfig `json:"subscriptions"`
+    // Routing rules, everything goes through the server if empty.
+    RulesFile   string      `json:"rules_file"`
+    // GeoIP database of GEOIP rules, a MaxMind .mmdb file or a text file with
+    // a country code and a CIDR on each line.
+    GeoIPFile   string      `json:"geoip_file"`
+    // Listen address of the http server of the PAC script, disabled if empty.
+    PacAddr     string      `json:"pac_addr"`
+    // Generate the PAC script from the GFWList instead of the rules.
+    GFWListFile string      `json:"gfwlist_file"`
+
+    // Authentication is required if not empty.
+    Users []*LocalUserConfig `json:"users"`
+
+    // Guards Servers, which is replaced as a whole when subscriptions are
+    // updated.
+    mutex sync.RWMutex
+    // The servers of the config itself, and of each subscription.
+    static []*ServerEndpointConfig
+    subscribed map[*SubscriptionConfig][]*ServerEndpointConfig
 }
 
 func ParseConfig(path string) (config *Config, err error) {
@@ -47,6 +157,177 @@ func ParseConfig(path string) (config *Config, err error) {
     return
 }
 
+// GetListeners returns the listeners of the shortcut options together with
+// the listeners configured in detail.
+func (c *Config)GetListeners() []*ListenerConfig {
+    var listeners []*ListenerConfig
+    if c.LocalAddr != "" {
+        protocol := "socks5"
+        if c.SniffHttp {
+            protocol = "mixed"
+        }
+        listeners = append(listeners, &ListenerConfig{Protocol: protocol, Address: c.LocalAddr})
+    }
+    if c.HttpAddr != "" {
+        listeners = append(listeners, &ListenerConfig{Protocol: "http", Address: c.HttpAddr})
+    }
+    if c.RedirAddr != "" {
+        listeners = append(listeners, &ListenerConfig{Protocol: "redir", Address: c.RedirAddr, RedirMode: c.RedirMode})
+    }
+    for _, tc := range c.Tunnels {
+        listeners = append(listeners, &ListenerConfig{Protocol: "tunnel", Address: tc.Listen, Target: tc.Target, Server: tc.Server})
+    }
+    return append(listeners, c.Listeners...)
+}
+
+func (c *Config)GetHandshakeTimeout() time.Duration {
+    if c.HandshakeTimeout == 0 {
+        return 30 * time.Second
+    }
+    return time.Duration(c.HandshakeTimeout) * time.Second
+}
+
+func (c *Config)GetConnectTimeout() time.Duration {
+    if c.ConnectTimeout == 0 {
+        return 10 * time.Second
+    }
+    return time.Duration(c.ConnectTimeout) * time.Second
+}
+
+func (c *Config)GetLingerTimeout() time.Duration {
+    if c.LingerTimeout == 0 {
+        return 30 * time.Second
+    }
+    return time.Duration(c.LingerTimeout) * time.Second
+}
+
+// ValidateUsers checks the users, and the servers they connect to. It must be
+// called after the servers are validated. A server not found is only warned of
+// with subscriptions, which may not be fetched yet.
+func (c *Config)ValidateUsers() error {
+    names := make(map[string]bool)
+    for _, user := range c.Users {
+        if user.Username == "" || len(user.Username) > 255 || len(user.Password) > 255 {
+            return fmt.Errorf("Invalid username or password of user %q", user.Username)
+        }
+        if names[user.Username] {
+            return fmt.Errorf("Duplicated user %q", user.Username)
+        }
+        names[user.Username] = true
+
+        if c.GetServer(user) == nil {
+            // The server may be in a subscription which isn't fetched yet.
+            if len(c.Subscriptions) == 0 {
+                return fmt.Errorf("Not found server %q of user %q", user.Server, user.Username)
+            }
+            fmt.Fprintf(os.Stderr, "Warning: not found server %q of user %q, it may be in the subscriptions\n", user.Server, user.Username)
+        }
+    }
+    return nil
+}
+
+// AuthRequired returns whether clients must authenticate with a user.
+func (c *Config)AuthRequired() bool {
+    return len(c.Users) > 0
+}
+
+// Authenticate returns the user matching the username and password, or nil.
+func (c *Config)Authenticate(username, password string) *LocalUserConfig {
+    return authenticateUser(c.Users, username, password)
+}
+
+func authenticateUser(users []*LocalUserConfig, username, password string) *LocalUserConfig {
+    for _, user := range users {
+        if user.Username == username {
+            if subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1 {
+                return user
+            }
+            return nil
+        }
+    }
+    return nil
+}
+
+// FindGroup returns the servers of the group.
+func (c *Config)FindGroup(group string) []*ServerEndpointConfig {
+    var servers []*ServerEndpointConfig
+    for _, ep := range c.servers() {
+        if ep.Group == group {
+            servers = append(servers, ep)
+        }
+    }
+    return servers
+}
+
+// FindServer returns the server with the name, or else the first server
+// with the name as its address, or nil.
+func (c *Config)FindServer(name string) *ServerEndpointConfig {
+    servers := c.servers()
+    for _, ep := range servers {
+        if ep.Name == name {
+            return ep
+        }
+    }
+    for _, ep := range servers {
+        if ep.Address == name {
+            return ep
+        }
+    }
+    return nil
+}
+
+// endpoint returns the server with the token of the user if it has one.
+func (c *LocalUserConfig)endpoint(ep *ServerEndpointConfig) *ServerEndpointConfig {
+    if ep == nil || c == nil || c.Token == "" {
+        return ep
+    }
+    copied := *ep
+    copied.Token = c.Token
+    copied.TokenSecret = c.TokenSecret
+    return &copied
+}
+
+// GetServer returns the server to connect to for the user, which may be nil
+// if authentication is not required. It is resolved from the current servers
+// on every call, as subscriptions may replace them, and is nil if the server
+// is not found.
+func (c *Config)GetServer(user *LocalUserConfig) *ServerEndpointConfig {
+    var ep *ServerEndpointConfig
+    if user == nil || user.Server == "" {
+        if servers := c.servers(); len(servers) > 0 {
+            ep = servers[0]
+        }
+    } else {
+        ep = c.FindServer(user.Server)
+    }
+    return user.endpoint(ep)
+}
+
+// servers returns the current servers, the slice is never modified once
+// published, so it can be used without the lock.
+func (c *Config)servers() []*ServerEndpointConfig {
+    c.mutex.RLock()
+    defer c.mutex.RUnlock()
+    return c.Servers
+}
+
+// setSubscribed replaces the servers of the subscription, which follow the
+// servers of the config itself in the order of the subscriptions.
+func (c *Config)setSubscribed(sc *SubscriptionConfig, servers []*ServerEndpointConfig) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if c.subscribed == nil {
+        c.static = c.Servers
+        c.subscribed = make(map[*SubscriptionConfig][]*ServerEndpointConfig)
+    }
+    c.subscribed[sc] = servers
+    merged := append([]*ServerEndpointConfig(nil), c.static...)
+    for _, v := range c.Subscriptions {
+        merged = append(merged, c.subscribed[v]...)
+    }
+    c.Servers = merged
+}
+
 func (c *ServerEndpointConfig)GetServerSecret() string {
     return c.Password
 }
@@ -59,6 +340,13 @@ func (c *ServerEndpointConfig)GetToken() (string, string) {
     return c.Token, c.TokenSecret
 }
 
+func (c *ServerEndpointConfig)GetExtensions() byte {
+    if c.ConnectStatus {
+        return ss.ExtConnectStatus
+    }
+    return 0
+}
+
 func (c *ServerEndpointConfig)NewHeaderCipher()*ss.Cipher {
     return c.headerCipher.Copy()
 }
@@ -86,12 +374,37 @@ func (c *ServerEndpointConfig)Validate() (bool, error) {
         fmt.Fprintln(os.Stderr, "Must specify method for server")
         valid = false
     }
+    if c.ConnectStatus && len(c.Token) > ss.TOKEN_SIZE-2 {
+        fmt.Fprintf(os.Stderr, "Token must be at most %v bytes with connect_status\n", ss.TOKEN_SIZE-2)
+        valid = false
+    }
+    if c.Plugin != "" || c.Mux || c.UDP {
+        fmt.Fprintf(os.Stderr, "Warning: plugin, mux and udp of server %v are not supported, connecting without them\n", c.Address)
+    }
 
     c.headerCipher, err = ss.NewCipher(c.Method, c.Password)
 
     return valid, err
 }
 
+// parseTunnelFlag parses a tunnel in listen=target format.
+func parseTunnelFlag(s string) (*TunnelConfig, error) {
+    parts := strings.SplitN(s, "=", 2)
+    if len(parts) != 2 {
+        return nil, fmt.Errorf("Invalid tunnel %q, should be listen=target", s)
+    }
+    return &TunnelConfig{Listen: parts[0], Target: parts[1]}, nil
+}
+
+// parseUserFlag parses a user in username:password format.
+func parseUserFlag(s string) (*LocalUserConfig, error) {
+    parts := strings.SplitN(s, ":", 2)
+    if len(parts) != 2 {
+        return nil, fmt.Errorf("Invalid user %q, should be username:password", s)
+    }
+    return &LocalUserConfig{Username: parts[0], Password: parts[1]}, nil
+}
+
 var (
     errNotFoundPasswordInUrl = errors.New("Not found password in SSP url")
     errNotFoundToeknInUrl = errors.New("Not found valid token info in SSP url")
@@ -102,24 +415,67 @@ func parseSSPUrl(rawurl string)(*ServerEndpointConfig, error) {
     if err != nil {
         return nil, err
     }
+    if u.Scheme != "ssp" {
+        return nil, fmt.Errorf("Invalid SSP url scheme %q", u.Scheme)
+    }
+    query := u.Query()
+    if v := query.Get("v"); v != "" {
+        if version, err := strconv.Atoi(v); err != nil || version < 1 || version > ss.SSP_URL_VERSION {
+            return nil, fmt.Errorf("Unsupported SSP url version %q", v)
+        }
+    }
 
-    password, ok:= u.User.Password()
-    if !ok {
+    if u.User == nil {
         return nil, errNotFoundPasswordInUrl
     }
+    method := u.User.Username()
+    password, ok := u.User.Password()
+    if !ok {
+        // method:password encoded in base64.
+        decoded, err := decodeBase64(method)
+        if err != nil {
+            return nil, errNotFoundPasswordInUrl
+        }
+        parts := strings.SplitN(string(decoded), ":", 2)
+        if len(parts) != 2 {
+            return nil, errNotFoundPasswordInUrl
+        }
+        method, password = parts[0], parts[1]
+    }
 
-    token := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+    token := strings.SplitN(strings.Trim(u.EscapedPath(), "/"), "/", 2)
     if len(token) != 2 {
         return nil, errNotFoundToeknInUrl
     }
+    for i := range token {
+        if token[i], err = url.PathUnescape(token[i]); err != nil {
+            return nil, errNotFoundToeknInUrl
+        }
+    }
 
     c := &ServerEndpointConfig{
+        Name: query.Get("name"),
+        DisplayName: u.Fragment,
         Address: u.Host,
-        Method: u.User.Username(),
+        Method: method,
         Password: password,
         Token: token[0],
         TokenSecret: token[1],
     }
+    if plugin := query.Get("plugin"); plugin != "" {
+        parts := strings.SplitN(plugin, ";", 2)
+        c.Plugin = parts[0]
+        if len(parts) == 2 {
+            c.PluginOpts = parts[1]
+        }
+    }
+    for key, value := range map[string]*bool{"cs": &c.ConnectStatus, "mux": &c.Mux, "udp": &c.UDP} {
+        if v := query.Get(key); v != "" {
+            if *value, err = strconv.ParseBool(v); err != nil {
+                return nil, fmt.Errorf("Invalid %v of SSP url: %q", key, v)
+            }
+        }
+    }
 
     if _, err = c.Validate(); err != nil {
         return nil, err
@@ -128,3 +484,21 @@ func parseSSPUrl(rawurl string)(*ServerEndpointConfig, error) {
     return c, nil
 }
 
+// URL formats the server as an ssp:// URL of the latest version.
+func (c *ServerEndpointConfig)URL() string {
+    u := &ss.SSPUrl{
+        Method: c.Method,
+        Password: c.Password,
+        Address: c.Address,
+        Token: c.Token,
+        TokenSecret: c.TokenSecret,
+        Name: c.Name,
+        DisplayName: c.DisplayName,
+        ConnectStatus: c.ConnectStatus,
+        Plugin: c.Plugin,
+        PluginOpts: c.PluginOpts,
+        Mux: c.Mux,
+        UDP: c.UDP,
+    }
+    return u.String()
+}
@@ -0,0 +1,458 @@
+package main
+import (
+    "io"
+    "net"
+    "sync"
+    "time"
+    "bufio"
+    "errors"
+    "strings"
+    "encoding/binary"
+    "golang.org/x/net/dns/dnsmessage"
+    log "github.com/Sirupsen/logrus"
+    ss "bitbucket.org/qiuyuzhou/shadowsocks/core"
+)
+
+var (
+    errDNSResponse = errors.New("DNS response doesn't match the query")
+)
+
+// DNSConfig configures the DNS forwarder, which listens on UDP and TCP, and
+// forwards queries to the upstream through the server with DNS over TCP.
+type DNSConfig struct {
+    Listen      string      `json:"listen"`
+    Upstream    string      `json:"upstream"`
+    // Optional, the name of the server, the first server by default.
+    Server      string      `json:"server"`
+    // Max number of cached responses, 4096 by default, negative to disable.
+    CacheSize   int         `json:"cache_size"`
+    // Queries of the domestic domains and their subdomains are sent to the
+    // domestic upstream directly over UDP.
+    DomesticUpstream string  `json:"domestic_upstream"`
+    DomesticDomains []string `json:"domestic_domains"`
+}
+
+type dnsCacheEntry struct {
+    response []byte
+    stored time.Time
+    expire time.Time
+}
+
+type DNSForwarder struct {
+    config DNSConfig
+    // Connects to the upstream through the server.
+    dialTunnel func(addr string) (net.Conn, error)
+
+    mutex sync.Mutex
+    cache map[string]*dnsCacheEntry
+    // Idle connections to the upstream through the server.
+    idle chan net.Conn
+}
+
+func NewDNSForwarder(config *DNSConfig) (*DNSForwarder, error) {
+    self := &DNSForwarder{
+        config: *config,
+        cache: make(map[string]*dnsCacheEntry),
+        idle: make(chan net.Conn, 4),
+    }
+    self.dialTunnel = self.dialServer
+    if self.config.Listen == "" || self.config.Upstream == "" {
+        return nil, errors.New("Must specify listen and upstream for dns")
+    }
+    if self.config.CacheSize == 0 {
+        self.config.CacheSize = 4096
+    }
+    self.config.DomesticDomains = make([]string, len(config.DomesticDomains))
+    for i, d := range config.DomesticDomains {
+        self.config.DomesticDomains[i] = strings.ToLower(strings.Trim(d, "."))
+    }
+    return self, nil
+}
+
+// Run serves on UDP and TCP, it only returns the errors of listening.
+func (self *DNSForwarder) Run() error {
+    pc, err := net.ListenPacket("udp", self.config.Listen)
+    if err != nil {
+        return err
+    }
+    ln, err := net.Listen("tcp", self.config.Listen)
+    if err != nil {
+        pc.Close()
+        return err
+    }
+    log.WithField("listen", self.config.Listen).Infof("starting local dns server listen on %v ...", self.config.Listen)
+    go self.serveTCP(ln)
+    self.serveUDP(pc)
+    ln.Close()
+    return nil
+}
+
+// retryDelay returns the delay before reading again after a temporary error,
+// which doubles up to a second as net/http.Server does, or false if the error
+// is permanent, such as the socket closed.
+func retryDelay(err error, delay time.Duration) (time.Duration, bool) {
+    if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+        return 0, false
+    }
+    if delay == 0 {
+        return 5 * time.Millisecond, true
+    }
+    if delay *= 2; delay > time.Second {
+        delay = time.Second
+    }
+    return delay, true
+}
+
+// serveUDP returns on permanent errors of reading.
+func (self *DNSForwarder) serveUDP(pc net.PacketConn) {
+    var delay time.Duration
+    for {
+        buf := make([]byte, 65535)
+        n, addr, err := pc.ReadFrom(buf)
+        if err != nil {
+            var ok bool
+            if delay, ok = retryDelay(err, delay); !ok {
+                log.WithField("error", err).Error("Read dns query error, stop serving udp.")
+                return
+            }
+            log.WithField("error", err).Warning("Read dns query error.")
+            time.Sleep(delay)
+            continue
+        }
+        delay = 0
+        go func() {
+            response := self.handleQuery(buf[:n])
+            if response == nil {
+                return
+            }
+            if response = truncateForUDP(buf[:n], response); response != nil {
+                pc.WriteTo(response, addr)
+            }
+        }()
+    }
+}
+
+// serveTCP returns on permanent errors of accepting.
+func (self *DNSForwarder) serveTCP(ln net.Listener) {
+    var delay time.Duration
+    for {
+        conn, err := ln.Accept()
+        if err != nil {
+            var ok bool
+            if delay, ok = retryDelay(err, delay); !ok {
+                log.WithField("error", err).Error("Accept connection error, stop serving tcp.")
+                return
+            }
+            log.WithField("error", err).Warning("Accept connection error.")
+            time.Sleep(delay)
+            continue
+        }
+        delay = 0
+        go func() {
+            defer conn.Close()
+            reader := bufio.NewReader(conn)
+            for {
+                conn.SetReadDeadline(time.Now().Add(config.GetHandshakeTimeout()))
+                query, err := readTCPMessage(reader)
+                if err != nil {
+                    return
+                }
+                response := self.handleQuery(query)
+                if response == nil {
+                    return
+                }
+                if err = writeTCPMessage(conn, response); err != nil {
+                    return
+                }
+            }
+        }()
+    }
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+    var length [2]byte
+    if _, err := io.ReadFull(r, length[:]); err != nil {
+        return nil, err
+    }
+    msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+    if _, err := io.ReadFull(r, msg); err != nil {
+        return nil, err
+    }
+    return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+    buf := make([]byte, 2+len(msg))
+    binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+    copy(buf[2:], msg)
+    _, err := w.Write(buf)
+    return err
+}
+
+// handleQuery returns the response of the query, or nil if the query can't be
+// parsed at all.
+func (self *DNSForwarder) handleQuery(query []byte) []byte {
+    var parser dnsmessage.Parser
+    header, err := parser.Start(query)
+    if err != nil {
+        return nil
+    }
+    questions, err := parser.AllQuestions()
+    if err != nil || len(questions) != 1 {
+        return errorResponse(header, questions, dnsmessage.RCodeFormatError)
+    }
+    question := questions[0]
+    key := strings.ToLower(question.Name.String()) + "/" + question.Type.String() + "/" + question.Class.String()
+
+    if response := self.cached(key, header.ID); response != nil {
+        return response
+    }
+
+    var response []byte
+    if self.isDomestic(question.Name.String()) {
+        response, err = self.exchangeDomestic(query)
+    } else {
+        response, err = self.exchangeTunnel(query)
+    }
+    if err == nil && (len(response) < 2 || binary.BigEndian.Uint16(response) != header.ID) {
+        err = errDNSResponse
+    }
+    if err != nil {
+        log.WithFields(log.Fields{"name": question.Name.String(), "error": err}).Debug("Forward dns query failed.")
+        return errorResponse(header, questions, dnsmessage.RCodeServerFailure)
+    }
+    self.store(key, response)
+    return response
+}
+
+func (self *DNSForwarder) isDomestic(name string) bool {
+    if self.config.DomesticUpstream == "" {
+        return false
+    }
+    name = strings.ToLower(strings.TrimSuffix(name, "."))
+    for _, d := range self.config.DomesticDomains {
+        if name == d || strings.HasSuffix(name, "."+d) {
+            return true
+        }
+    }
+    return false
+}
+
+func (self *DNSForwarder) exchangeDomestic(query []byte) ([]byte, error) {
+    conn, err := net.DialTimeout("udp", self.config.DomesticUpstream, config.GetConnectTimeout())
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(config.GetConnectTimeout()))
+    if _, err = conn.Write(query); err != nil {
+        return nil, err
+    }
+    buf := make([]byte, 65535)
+    n, err := conn.Read(buf)
+    if err != nil {
+        return nil, err
+    }
+    return buf[:n], nil
+}
+
+// dialServer connects to addr through the server of the forwarder, which is
+// looked up on every connection, as the servers may be updated.
+func (self *DNSForwarder) dialServer(addr string) (net.Conn, error) {
+    ep := config.GetServer(nil)
+    if self.config.Server != "" {
+        ep = config.FindServer(self.config.Server)
+    }
+    if ep == nil {
+        return nil, errNoServer
+    }
+    return ss.DialTimeout(addr, ep.Address, ep, config.GetConnectTimeout())
+}
+
+// exchangeTunnel sends the query over TCP through the server, reusing idle
+// connections. A failed idle connection is retried with a new one.
+func (self *DNSForwarder) exchangeTunnel(query []byte) ([]byte, error) {
+    for {
+        var conn net.Conn
+        reused := false
+        select {
+            case conn = <-self.idle:
+                reused = true
+            default:
+                var err error
+                conn, err = self.dialTunnel(self.config.Upstream)
+                if err != nil {
+                    return nil, err
+                }
+        }
+        conn.SetDeadline(time.Now().Add(config.GetConnectTimeout()))
+        err := writeTCPMessage(conn, query)
+        var response []byte
+        if err == nil {
+            response, err = readTCPMessage(conn)
+        }
+        if err != nil {
+            conn.Close()
+            if reused {
+                continue
+            }
+            return nil, err
+        }
+        conn.SetDeadline(time.Time{})
+        select {
+            case self.idle <- conn:
+            default:
+                conn.Close()
+        }
+        return response, nil
+    }
+}
+
+// minTTL returns the smallest TTL in the response, ok is false if it has no
+// records.
+func minTTL(msg *dnsmessage.Message) (ttl uint32, ok bool) {
+    for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities} {
+        for _, r := range section {
+            if !ok || r.Header.TTL < ttl {
+                ttl = r.Header.TTL
+                ok = true
+            }
+        }
+    }
+    return
+}
+
+func (self *DNSForwarder) store(key string, response []byte) {
+    if self.config.CacheSize < 0 {
+        return
+    }
+    var msg dnsmessage.Message
+    if err := msg.Unpack(response); err != nil || msg.Truncated {
+        return
+    }
+    if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+        return
+    }
+    ttl, ok := minTTL(&msg)
+    if !ok || ttl == 0 {
+        return
+    }
+    now := time.Now()
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+    if len(self.cache) >= self.config.CacheSize {
+        for k, entry := range self.cache {
+            if now.After(entry.expire) {
+                delete(self.cache, k)
+            }
+        }
+        // Still full, drop an arbitrary entry.
+        for k := range self.cache {
+            if len(self.cache) < self.config.CacheSize {
+                break
+            }
+            delete(self.cache, k)
+        }
+    }
+    self.cache[key] = &dnsCacheEntry{
+        response: append([]byte(nil), response...),
+        stored: now,
+        expire: now.Add(time.Duration(ttl) * time.Second),
+    }
+}
+
+// cached returns the cached response with the id, and the TTLs reduced by the
+// time passed.
+func (self *DNSForwarder) cached(key string, id uint16) []byte {
+    self.mutex.Lock()
+    entry, ok := self.cache[key]
+    self.mutex.Unlock()
+    now := time.Now()
+    if !ok || now.After(entry.expire) {
+        return nil
+    }
+
+    var msg dnsmessage.Message
+    if err := msg.Unpack(entry.response); err != nil {
+        return nil
+    }
+    msg.ID = id
+    elapsed := uint32(now.Sub(entry.stored) / time.Second)
+    for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+        for i := range section {
+            if section[i].Header.Type == dnsmessage.TypeOPT {
+                continue
+            }
+            if section[i].Header.TTL > elapsed {
+                section[i].Header.TTL -= elapsed
+            } else {
+                section[i].Header.TTL = 0
+            }
+        }
+    }
+    response, err := msg.Pack()
+    if err != nil {
+        return nil
+    }
+    return response
+}
+
+func errorResponse(header dnsmessage.Header, questions []dnsmessage.Question, rcode dnsmessage.RCode) []byte {
+    msg := dnsmessage.Message{
+        Header: dnsmessage.Header{
+            ID: header.ID,
+            Response: true,
+            OpCode: header.OpCode,
+            RecursionDesired: header.RecursionDesired,
+            RecursionAvailable: true,
+            RCode: rcode,
+        },
+        Questions: questions,
+    }
+    response, err := msg.Pack()
+    if err != nil {
+        return nil
+    }
+    return response
+}
+
+// truncateForUDP returns the response itself if it fits in the UDP payload
+// size of the query, or a truncated one which makes the client retry over
+// TCP.
+func truncateForUDP(query, response []byte) []byte {
+    size := 512
+    var parser dnsmessage.Parser
+    if _, err := parser.Start(query); err == nil {
+        parser.SkipAllQuestions()
+        parser.SkipAllAnswers()
+        parser.SkipAllAuthorities()
+        for {
+            h, err := parser.AdditionalHeader()
+            if err != nil {
+                break
+            }
+            if h.Type == dnsmessage.TypeOPT && int(h.Class) > size {
+                size = int(h.Class)
+            }
+            parser.SkipAdditional()
+        }
+    }
+    if len(response) <= size {
+        return response
+    }
+
+    var p dnsmessage.Parser
+    header, err := p.Start(response)
+    if err != nil {
+        return nil
+    }
+    questions, _ := p.AllQuestions()
+    header.Truncated = true
+    msg := dnsmessage.Message{Header: header, Questions: questions}
+    truncated, err := msg.Pack()
+    if err != nil {
+        return nil
+    }
+    return truncated
+}
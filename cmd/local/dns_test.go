@@ -0,0 +1,222 @@
+package main
+import (
+    "net"
+    "time"
+    "bufio"
+    "testing"
+    "golang.org/x/net/dns/dnsmessage"
+    a "github.com/stretchr/testify/assert"
+)
+
+func newTestQuery(t *testing.T, id uint16, name string) []byte {
+    msg := dnsmessage.Message{
+        Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+        Questions: []dnsmessage.Question{{
+            Name: dnsmessage.MustNewName(name),
+            Type: dnsmessage.TypeA,
+            Class: dnsmessage.ClassINET,
+        }},
+    }
+    query, err := msg.Pack()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return query
+}
+
+// fakeDNSServer answers every A query with 10.0.0.1, and counts the queries.
+func fakeDNSServer(t *testing.T) (net.PacketConn, chan int) {
+    pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    count := make(chan int, 100)
+    go func() {
+        buf := make([]byte, 512)
+        for {
+            n, addr, err := pc.ReadFrom(buf)
+            if err != nil {
+                return
+            }
+            var msg dnsmessage.Message
+            if msg.Unpack(buf[:n]) != nil {
+                continue
+            }
+            msg.Response = true
+            msg.Answers = []dnsmessage.Resource{{
+                Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+                Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+            }}
+            response, _ := msg.Pack()
+            pc.WriteTo(response, addr)
+            count <- 1
+        }
+    }()
+    return pc, count
+}
+
+func TestDNSForwarderDomesticAndCache(t *testing.T) {
+    pc, count := fakeDNSServer(t)
+    defer pc.Close()
+
+    forwarder, err := NewDNSForwarder(&DNSConfig{
+        Listen: "127.0.0.1:0",
+        Upstream: "8.8.8.8:53",
+        DomesticUpstream: pc.LocalAddr().String(),
+        DomesticDomains: []string{".example.cn"},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    a.True(t, forwarder.isDomestic("www.Example.cn."))
+    a.False(t, forwarder.isDomestic("example.com."))
+
+    for _, id := range []uint16{1, 2} {
+        response := forwarder.handleQuery(newTestQuery(t, id, "www.example.cn."))
+        var msg dnsmessage.Message
+        if err := msg.Unpack(response); err != nil {
+            t.Fatal(err)
+        }
+        a.Equal(t, id, msg.ID)
+        a.Equal(t, 1, len(msg.Answers))
+        a.True(t, msg.Answers[0].Header.TTL <= 300)
+    }
+    // The second query is answered from the cache.
+    a.Equal(t, 1, len(count))
+}
+
+// fakeTCPDNSServer answers the A queries over TCP with 10.0.0.2, and closes
+// every connection after two queries, as upstreams close idle connections.
+func fakeTCPDNSServer(t *testing.T) net.Listener {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                reader := bufio.NewReader(conn)
+                for i := 0; i < 2; i++ {
+                    query, err := readTCPMessage(reader)
+                    if err != nil {
+                        return
+                    }
+                    var msg dnsmessage.Message
+                    if msg.Unpack(query) != nil {
+                        return
+                    }
+                    msg.Response = true
+                    msg.Answers = []dnsmessage.Resource{{
+                        Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+                        Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 2}},
+                    }}
+                    response, _ := msg.Pack()
+                    writeTCPMessage(conn, response)
+                }
+            }()
+        }
+    }()
+    return ln
+}
+
+func TestDNSForwarderTunnel(t *testing.T) {
+    saved := config
+    defer func() { config = saved }()
+    config = &Config{}
+
+    ln := fakeTCPDNSServer(t)
+    defer ln.Close()
+    forwarder, err := NewDNSForwarder(&DNSConfig{
+        Listen: "127.0.0.1:0",
+        Upstream: "8.8.8.8:53",
+        CacheSize: -1,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    var dialed []string
+    forwarder.dialTunnel = func(addr string) (net.Conn, error) {
+        dialed = append(dialed, addr)
+        return net.Dial("tcp", ln.Addr().String())
+    }
+
+    for id := uint16(1); id <= 3; id++ {
+        response := forwarder.handleQuery(newTestQuery(t, id, "example.com."))
+        var msg dnsmessage.Message
+        if err := msg.Unpack(response); err != nil {
+            t.Fatal(err)
+        }
+        a.Equal(t, id, msg.ID)
+        a.Equal(t, dnsmessage.RCodeSuccess, msg.RCode, "query %v", id)
+        a.Equal(t, 1, len(msg.Answers), "query %v", id)
+        if id == 2 {
+            // The idle connection is reused.
+            a.Equal(t, []string{"8.8.8.8:53"}, dialed)
+        }
+    }
+    // The connection closed by the upstream is retried with a new one.
+    a.Equal(t, []string{"8.8.8.8:53", "8.8.8.8:53"}, dialed)
+    a.Equal(t, 1, len(forwarder.idle))
+
+    // Errors of new connections are not retried.
+    forwarder.dialTunnel = func(addr string) (net.Conn, error) {
+        return nil, errNoServer
+    }
+    (<-forwarder.idle).Close()
+    _, err = forwarder.exchangeTunnel(newTestQuery(t, 4, "example.com."))
+    a.Equal(t, errNoServer, err)
+}
+
+func TestDNSForwarderClosed(t *testing.T) {
+    forwarder, err := NewDNSForwarder(&DNSConfig{Listen: "127.0.0.1:0", Upstream: "8.8.8.8:53"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    pc.Close()
+    ln.Close()
+    // Both return instead of spinning on the closed sockets.
+    done := make(chan bool, 2)
+    go func() { forwarder.serveUDP(pc); done <- true }()
+    go func() { forwarder.serveTCP(ln); done <- true }()
+    for i := 0; i < 2; i++ {
+        select {
+            case <-done:
+            case <-time.After(5 * time.Second):
+                t.Fatal("serving a closed socket didn't return")
+        }
+    }
+}
+
+func TestTruncateForUDP(t *testing.T) {
+    query := newTestQuery(t, 1, "example.com.")
+    small := errorResponse(dnsmessage.Header{ID: 1}, nil, dnsmessage.RCodeSuccess)
+    a.Equal(t, small, truncateForUDP(query, small))
+
+    msg := dnsmessage.Message{Header: dnsmessage.Header{ID: 1, Response: true}}
+    name := dnsmessage.MustNewName("example.com.")
+    msg.Questions = []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}}
+    for i := 0; i < 50; i++ {
+        msg.Answers = append(msg.Answers, dnsmessage.Resource{
+            Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+            Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, byte(i)}},
+        })
+    }
+    large, _ := msg.Pack()
+    var truncated dnsmessage.Message
+    a.Nil(t, truncated.Unpack(truncateForUDP(query, large)))
+    a.True(t, truncated.Truncated)
+    a.Equal(t, 0, len(truncated.Answers))
+}
@@ -0,0 +1,123 @@
+package main
+import (
+    "os"
+    "net"
+    "sort"
+    "bufio"
+    "bytes"
+    "fmt"
+    "strings"
+    "github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP looks up the ISO country code of IPs.
+type GeoIP interface {
+    Country(ip net.IP) string
+}
+
+// LoadGeoIP opens a MaxMind database if path ends with .mmdb, or a text file
+// with a country code and a CIDR on each line otherwise.
+func LoadGeoIP(path string) (GeoIP, error) {
+    if strings.HasSuffix(strings.ToLower(path), ".mmdb") {
+        return loadMaxMindGeoIP(path)
+    }
+    return loadCIDRGeoIP(path)
+}
+
+type maxMindGeoIP struct {
+    reader *maxminddb.Reader
+}
+
+func loadMaxMindGeoIP(path string) (*maxMindGeoIP, error) {
+    reader, err := maxminddb.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    return &maxMindGeoIP{reader: reader}, nil
+}
+
+func (self *maxMindGeoIP) Country(ip net.IP) string {
+    var record struct {
+        Country struct {
+            ISOCode string `maxminddb:"iso_code"`
+        } `maxminddb:"country"`
+    }
+    if err := self.reader.Lookup(ip, &record); err != nil {
+        return ""
+    }
+    return record.Country.ISOCode
+}
+
+type cidrRange struct {
+    start net.IP
+    end net.IP
+    country string
+}
+
+// cidrGeoIP keeps the networks sorted by their first address, which must not
+// overlap.
+type cidrGeoIP struct {
+    ranges []cidrRange
+}
+
+func loadCIDRGeoIP(path string) (*cidrGeoIP, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    self := &cidrGeoIP{}
+    scanner := bufio.NewScanner(file)
+    lineNo := 0
+    for scanner.Scan() {
+        lineNo++
+        line := scanner.Text()
+        if i := strings.IndexByte(line, '#'); i >= 0 {
+            line = line[:i]
+        }
+        fields := strings.Fields(line)
+        if len(fields) == 0 {
+            continue
+        }
+        if len(fields) != 2 {
+            return nil, fmt.Errorf("Invalid GeoIP entry at line %v: %v", lineNo, line)
+        }
+        _, ipnet, err := net.ParseCIDR(fields[1])
+        if err != nil {
+            return nil, fmt.Errorf("Invalid GeoIP entry at line %v: %v", lineNo, err)
+        }
+        start := ipnet.IP.To16()
+        end := make(net.IP, net.IPv6len)
+        mask := ipnet.Mask
+        if len(mask) == net.IPv4len {
+            mask = append(net.CIDRMask(96, 128)[:12], mask...)
+        }
+        for i := range end {
+            end[i] = start[i] | ^mask[i]
+        }
+        self.ranges = append(self.ranges, cidrRange{start: start, end: end, country: strings.ToUpper(fields[0])})
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    sort.Slice(self.ranges, func(i, j int) bool {
+        return bytes.Compare(self.ranges[i].start, self.ranges[j].start) < 0
+    })
+    return self, nil
+}
+
+func (self *cidrGeoIP) Country(ip net.IP) string {
+    ip = ip.To16()
+    if ip == nil {
+        return ""
+    }
+    // The last range starting at or before ip.
+    i := sort.Search(len(self.ranges), func(i int) bool {
+        return bytes.Compare(self.ranges[i].start, ip) > 0
+    }) - 1
+    if i >= 0 && bytes.Compare(ip, self.ranges[i].end) <= 0 {
+        return self.ranges[i].country
+    }
+    return ""
+}
@@ -0,0 +1,247 @@
+package main
+import (
+    "net"
+    "io"
+    "bufio"
+    "strings"
+    "net/http"
+    "time"
+    "encoding/base64"
+    log "github.com/Sirupsen/logrus"
+    ss "bitbucket.org/qiuyuzhou/shadowsocks/core"
+)
+
+// Hop-by-hop headers which are not forwarded to the server, RFC 2616 13.5.1.
+var hopHeaders = []string{
+    "Connection",
+    "Keep-Alive",
+    "Proxy-Authenticate",
+    "Proxy-Authorization",
+    "Proxy-Connection",
+    "Te",
+    "Trailer",
+    "Transfer-Encoding",
+    "Upgrade",
+}
+
+// bufferedConn keeps the data read ahead by a bufio.Reader, while sniffing
+// the protocol or parsing the http request.
+type bufferedConn struct {
+    net.Conn
+    reader *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+    if bc, ok := conn.(*bufferedConn); ok {
+        return bc
+    }
+    return &bufferedConn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+    return c.reader.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+    return ss.CloseWrite(c.Conn)
+}
+
+// requestHostPort returns the destination of the proxy request in host:port.
+func requestHostPort(req *http.Request) string {
+    host := req.Host
+    if req.URL.Host != "" {
+        host = req.URL.Host
+    }
+    if _, _, err := net.SplitHostPort(host); err != nil {
+        if req.URL.Scheme == "https" {
+            host = net.JoinHostPort(strings.Trim(host, "[]"), "443")
+        } else {
+            host = net.JoinHostPort(strings.Trim(host, "[]"), "80")
+        }
+    }
+    return host
+}
+
+func writeHttpError(conn net.Conn, status int) {
+    resp := &http.Response{
+        StatusCode: status,
+        ProtoMajor: 1,
+        ProtoMinor: 1,
+        Header: http.Header{"Connection": []string{"close"}},
+    }
+    resp.Write(conn)
+}
+
+// httpProxyUser authenticates the request with the Proxy-Authorization
+// header, it returns false if authentication is required but failed.
+func httpProxyUser(l *Listener, req *http.Request) (*LocalUserConfig, bool) {
+    if !l.AuthRequired() {
+        return nil, true
+    }
+    auth := req.Header.Get("Proxy-Authorization")
+    const prefix = "Basic "
+    if !strings.HasPrefix(auth, prefix) {
+        return nil, false
+    }
+    decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+    if err != nil {
+        return nil, false
+    }
+    parts := strings.SplitN(string(decoded), ":", 2)
+    if len(parts) != 2 {
+        return nil, false
+    }
+    user := l.Authenticate(parts[0], parts[1])
+    return user, user != nil
+}
+
+// httpErrorStatus maps the error of connecting to a status code.
+func httpErrorStatus(err error) int {
+    if err == ss.ErrConnectDenied || err == errRejected {
+        return http.StatusForbidden
+    }
+    if ne, ok := err.(net.Error); ok && ne.Timeout() {
+        return http.StatusGatewayTimeout
+    }
+    return http.StatusBadGateway
+}
+
+func handleHttpConnection(l *Listener, rawConn net.Conn) {
+    conn := newBufferedConn(rawConn)
+    closed := false
+    defer func() {
+        if !closed {
+            conn.Close()
+        }
+    }()
+
+    conn.SetDeadline(time.Now().Add(config.GetHandshakeTimeout()))
+    req, err := http.ReadRequest(conn.reader)
+    if err != nil {
+        log.Warning("error reading http request:", err)
+        return
+    }
+    conn.SetDeadline(time.Time{})
+
+    user, ok := httpProxyUser(l, req)
+    if !ok {
+        resp := &http.Response{
+            StatusCode: http.StatusProxyAuthRequired,
+            ProtoMajor: 1,
+            ProtoMinor: 1,
+            Header: http.Header{
+                "Connection": []string{"close"},
+                "Proxy-Authenticate": []string{`Basic realm="ssplocal"`},
+            },
+        }
+        resp.Write(conn)
+        return
+    }
+    if req.Method == "CONNECT" {
+        closed = handleHttpConnect(l, conn, req, user)
+        return
+    }
+    handleHttpForward(l, conn, req, user)
+}
+
+// handleHttpConnect tunnels the connection, it returns whether conn is
+// closed by the relay.
+func handleHttpConnect(l *Listener, conn *bufferedConn, req *http.Request, user *LocalUserConfig) bool {
+    addr := requestHostPort(req)
+    rawaddr, err := ss.RawAddr(addr)
+    if err != nil {
+        writeHttpError(conn, http.StatusBadRequest)
+        return false
+    }
+    remote, err := dialRemote(l, user, rawaddr, addr)
+    if err != nil {
+        log.Debugf("error when create connection to server: %v\n", err)
+        writeHttpError(conn, httpErrorStatus(err))
+        return false
+    }
+    if _, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+        log.WithField("error", err).Debug("send connection confirmation error")
+        remote.Close()
+        return false
+    }
+
+    log.WithField("addr", addr).Infof("Proxy http connection to %v", addr)
+    relayConn(conn, remote)
+    return true
+}
+
+// handleHttpForward forwards the requests with absolute URIs, reusing the
+// connection to the server while the requests go to the same host.
+func handleHttpForward(l *Listener, conn *bufferedConn, req *http.Request, user *LocalUserConfig) {
+    var remote net.Conn
+    var remoteReader *bufio.Reader
+    var remoteAddr string
+    defer func() {
+        if remote != nil {
+            remote.Close()
+        }
+    }()
+
+    for {
+        if !req.URL.IsAbs() {
+            writeHttpError(conn, http.StatusBadRequest)
+            return
+        }
+        addr := requestHostPort(req)
+        if remote == nil || addr != remoteAddr {
+            if remote != nil {
+                remote.Close()
+                remote = nil
+            }
+            rawaddr, err := ss.RawAddr(addr)
+            if err != nil {
+                writeHttpError(conn, http.StatusBadRequest)
+                return
+            }
+            if remote, err = dialRemote(l, user, rawaddr, addr); err != nil {
+                log.Debugf("error when create connection to server: %v\n", err)
+                writeHttpError(conn, httpErrorStatus(err))
+                return
+            }
+            remoteReader = bufio.NewReader(remote)
+            remoteAddr = addr
+            log.WithField("addr", addr).Infof("Proxy http request to %v", addr)
+        }
+
+        closeAfter := req.Close
+        for _, h := range hopHeaders {
+            req.Header.Del(h)
+        }
+        req.RequestURI = ""
+        if err := req.Write(remote); err != nil {
+            log.WithField("error", err).Debug("write http request error")
+            return
+        }
+        resp, err := http.ReadResponse(remoteReader, req)
+        if err != nil {
+            log.WithField("error", err).Debug("read http response error")
+            writeHttpError(conn, http.StatusBadGateway)
+            return
+        }
+        closeAfter = closeAfter || resp.Close
+        for _, h := range hopHeaders {
+            resp.Header.Del(h)
+        }
+        err = resp.Write(conn)
+        resp.Body.Close()
+        if err != nil || closeAfter {
+            return
+        }
+
+        if config.Timeout > 0 {
+            conn.SetReadDeadline(time.Now().Add(time.Duration(config.Timeout) * time.Second))
+        }
+        if req, err = http.ReadRequest(conn.reader); err != nil {
+            if err != io.EOF {
+                log.WithField("error", err).Debug("read http request error")
+            }
+            return
+        }
+        conn.SetReadDeadline(time.Time{})
+    }
+}
@@ -0,0 +1,157 @@
+package main
+import (
+    "net"
+    "fmt"
+    "sync/atomic"
+    "errors"
+    log "github.com/Sirupsen/logrus"
+)
+
+var (
+    errNoServer = errors.New("Not found server to connect to.")
+)
+
+// Listener serves one protocol on a local address, with its own users and
+// servers.
+type Listener struct {
+    config *ListenerConfig
+    // Authentication is required if not empty.
+    users []*LocalUserConfig
+    next uint32
+}
+
+func NewListener(lc *ListenerConfig, config *Config) (*Listener, error) {
+    self := &Listener{config: lc}
+    if lc.Address == "" {
+        return nil, fmt.Errorf("Must specify address for listener")
+    }
+    switch lc.Protocol {
+        case "":
+            lc.Protocol = "socks5"
+        case "socks5", "http", "mixed":
+        case "redir":
+            if lc.RedirMode == "" {
+                lc.RedirMode = "redirect"
+            }
+            if lc.RedirMode != "redirect" && lc.RedirMode != "tproxy" {
+                return nil, fmt.Errorf("Unknown redir mode %v of listener %v", lc.RedirMode, lc.Address)
+            }
+        case "tunnel":
+            if _, _, err := net.SplitHostPort(lc.Target); err != nil {
+                return nil, fmt.Errorf("Invalid target of tunnel %v: %v", lc.Address, err)
+            }
+        default:
+            return nil, fmt.Errorf("Unknown protocol %v of listener %v", lc.Protocol, lc.Address)
+    }
+
+    if !lc.NoAuth {
+        if lc.Users == nil {
+            self.users = config.Users
+        }
+        for _, name := range lc.Users {
+            var found *LocalUserConfig
+            for _, user := range config.Users {
+                if user.Username == name {
+                    found = user
+                    break
+                }
+            }
+            if found == nil {
+                return nil, fmt.Errorf("Not found user %q of listener %v", name, lc.Address)
+            }
+            self.users = append(self.users, found)
+        }
+    }
+
+    if lc.Server != "" && config.FindServer(lc.Server) == nil {
+        return nil, fmt.Errorf("Not found server %q of listener %v", lc.Server, lc.Address)
+    }
+    if lc.Group != "" && len(config.FindGroup(lc.Group)) == 0 {
+        return nil, fmt.Errorf("Not found servers of group %q of listener %v", lc.Group, lc.Address)
+    }
+    if lc.Server == "" && lc.Group == "" && config.GetServer(nil) == nil {
+        return nil, fmt.Errorf("Not found server of listener %v", lc.Address)
+    }
+    return self, nil
+}
+
+func (self *Listener) AuthRequired() bool {
+    return len(self.users) > 0
+}
+
+// Authenticate returns the user of the listener matching the username and
+// password, or nil.
+func (self *Listener) Authenticate(username, password string) *LocalUserConfig {
+    return authenticateUser(self.users, username, password)
+}
+
+// Server returns the server to connect to for the user, the server of the
+// user, or else of the listener, or else of its group, or else the first
+// server, with the token of the user if it has one. It is nil if the server
+// pinned is not found. The servers are looked up on every connection, as they
+// may be updated.
+func (self *Listener) Server(user *LocalUserConfig) *ServerEndpointConfig {
+    var ep *ServerEndpointConfig
+    switch {
+        case user != nil && user.Server != "":
+            if ep = config.FindServer(user.Server); ep == nil {
+                log.WithField("user", user.Username).Warningf("Not found server %q of user", user.Server)
+            }
+        case self.config.Server != "":
+            if ep = config.FindServer(self.config.Server); ep == nil {
+                log.WithField("listen", self.config.Address).Warningf("Not found server %q of listener", self.config.Server)
+            }
+        case self.config.Group != "":
+            if servers := config.FindGroup(self.config.Group); len(servers) > 0 {
+                i := atomic.AddUint32(&self.next, 1)
+                ep = servers[int(i) % len(servers)]
+            } else {
+                log.WithField("listen", self.config.Address).Warningf("Not found servers of group %q of listener", self.config.Group)
+            }
+        default:
+            ep = config.GetServer(nil)
+    }
+    return user.endpoint(ep)
+}
+
+func (self *Listener) handler() func(net.Conn) {
+    switch self.config.Protocol {
+        case "http":
+            return func(conn net.Conn) { handleHttpConnection(self, conn) }
+        case "mixed":
+            return func(conn net.Conn) { handleMixedConnection(self, conn) }
+        case "redir":
+            return func(conn net.Conn) { handleRedirConnection(self, conn) }
+        case "tunnel":
+            return func(conn net.Conn) { handleTunnelConnection(self, conn) }
+    }
+    return func(conn net.Conn) { handleConnection(self, conn) }
+}
+
+// Run listens and serves, it only returns on errors of listening.
+func (self *Listener) Run() error {
+    var ln net.Listener
+    var err error
+    if self.config.Protocol == "redir" {
+        ln, err = listenRedir(self.config.Address, self.config.RedirMode == "tproxy")
+    } else {
+        ln, err = net.Listen("tcp", self.config.Address)
+    }
+    if err != nil {
+        return err
+    }
+    protocol := self.config.Protocol
+    if protocol == "tunnel" {
+        protocol = "tunnel to " + self.config.Target
+    }
+    log.WithField("listen", self.config.Address).Infof("starting local %v server listen on %v ...", protocol, self.config.Address)
+    handler := self.handler()
+    for {
+        conn, err := ln.Accept()
+        if err != nil {
+            log.WithField("error", err).Warning("Accept connection error.")
+            continue
+        }
+        go handler(conn)
+    }
+}
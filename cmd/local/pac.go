@@ -0,0 +1,311 @@
+package main
+import (
+    "os"
+    "net"
+    "net/http"
+    "bytes"
+    "bufio"
+    "fmt"
+    "sync"
+    "time"
+    "strings"
+    "io/ioutil"
+    "encoding/json"
+    "encoding/base64"
+    log "github.com/Sirupsen/logrus"
+)
+
+// PacServer serves a PAC script generated from the routing rules, or from a
+// GFWList if given. The script is regenerated when the rules are reloaded or
+// the GFWList changes.
+type PacServer struct {
+    rules *RouterFile
+    gfwListFile string
+
+    mutex sync.Mutex
+    // The source of the script.
+    router *Router
+    modTime time.Time
+    script string
+}
+
+func NewPacServer(rules *RouterFile, gfwListFile string) (*PacServer, error) {
+    if rules == nil && gfwListFile == "" {
+        return nil, fmt.Errorf("Must specify rules_file or gfwlist_file to serve PAC")
+    }
+    self := &PacServer{rules: rules, gfwListFile: gfwListFile}
+    if err := self.refresh(); err != nil {
+        return nil, err
+    }
+    return self, nil
+}
+
+// refresh regenerates the script if the source is modified. The last script
+// is kept if the new one fails.
+func (self *PacServer) refresh() error {
+    if self.gfwListFile == "" {
+        router := self.rules.Router()
+        self.mutex.Lock()
+        defer self.mutex.Unlock()
+        if router != self.router {
+            self.script = router.pacScript()
+            self.router = router
+            log.WithField("file", self.rules.path).Info("Generated PAC script.")
+        }
+        return nil
+    }
+
+    stat, err := os.Stat(self.gfwListFile)
+    if err != nil {
+        return err
+    }
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+    if self.script != "" && self.modTime.Equal(stat.ModTime()) {
+        return nil
+    }
+    list, err := loadGFWList(self.gfwListFile)
+    if err != nil {
+        return err
+    }
+    self.script = list.pacScript()
+    self.modTime = stat.ModTime()
+    log.WithField("file", self.gfwListFile).Info("Generated PAC script.")
+    return nil
+}
+
+// pacProxy returns the proxies of the PAC script, the unspecified listen
+// addresses are replaced by the host which the script is requested from.
+func pacProxy(host string) string {
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+    listenAddr := func(addr string) string {
+        h, port, err := net.SplitHostPort(addr)
+        if err != nil {
+            return addr
+        }
+        if ip := net.ParseIP(h); h == "" || (ip != nil && ip.IsUnspecified()) {
+            h = host
+        }
+        return net.JoinHostPort(h, port)
+    }
+    // The first listeners of socks and http.
+    var socks, proxy string
+    for _, lc := range config.GetListeners() {
+        switch lc.Protocol {
+            case "", "socks5":
+                if socks == "" {
+                    socks = listenAddr(lc.Address)
+                }
+            case "http":
+                if proxy == "" {
+                    proxy = listenAddr(lc.Address)
+                }
+            case "mixed":
+                if socks == "" {
+                    socks = listenAddr(lc.Address)
+                }
+                if proxy == "" {
+                    proxy = listenAddr(lc.Address)
+                }
+        }
+    }
+    var proxies []string
+    if socks != "" {
+        proxies = append(proxies, "SOCKS5 " + socks, "SOCKS " + socks)
+    }
+    if proxy != "" {
+        proxies = append(proxies, "PROXY " + proxy)
+    }
+    if len(proxies) == 0 {
+        return "DIRECT"
+    }
+    return strings.Join(proxies, "; ")
+}
+
+func (self *PacServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if err := self.refresh(); err != nil {
+        log.WithField("error", err).Warning("Refresh PAC script failed.")
+    }
+    self.mutex.Lock()
+    script := self.script
+    self.mutex.Unlock()
+
+    proxy, _ := json.Marshal(pacProxy(r.Host))
+    w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+    fmt.Fprintf(w, "var proxy = %s;\n%s", proxy, script)
+}
+
+func jsString(s string) string {
+    b, _ := json.Marshal(s)
+    return string(b)
+}
+
+// pacScript translates the rules to a FindProxyForURL function which uses
+// the variable proxy. Only DIRECT is taken from the rules, other actions go to
+// ssplocal which applies the rules again. Rules which can't be checked in the
+// script, like GEOIP and DST-PORT, send the rest of the destinations to
+// ssplocal, unless they are DIRECT.
+func (self *Router) pacScript() string {
+    var buf bytes.Buffer
+    buf.WriteString("function FindProxyForURL(url, host) {\n")
+    buf.WriteString("    var isIP = /^[0-9.]+$/.test(host) || host.indexOf(\":\") >= 0;\n")
+    ret := func(action RouteAction) string {
+        if action.Kind == routeDirect {
+            return "\"DIRECT\""
+        }
+        return "proxy"
+    }
+    for _, r := range self.rules {
+        var cond string
+        switch r.kind {
+            case "DOMAIN":
+                cond = fmt.Sprintf("!isIP && host == %s", jsString(strings.ToLower(r.value)))
+            case "DOMAIN-SUFFIX":
+                value := strings.ToLower(strings.TrimPrefix(r.value, "."))
+                cond = fmt.Sprintf("!isIP && (host == %s || dnsDomainIs(host, %s))", jsString(value), jsString("."+value))
+            case "DOMAIN-KEYWORD":
+                cond = fmt.Sprintf("!isIP && host.indexOf(%s) >= 0", jsString(strings.ToLower(r.value)))
+            case "DOMAIN-REGEX":
+                cond = fmt.Sprintf("!isIP && new RegExp(%s).test(host)", jsString(r.value))
+            case "IP-CIDR":
+                _, ipnet, err := net.ParseCIDR(r.value)
+                if err == nil && ipnet.IP.To4() != nil {
+                    cond = fmt.Sprintf("isInNet(host, %s, %s)", jsString(ipnet.IP.String()), jsString(net.IP(ipnet.Mask).String()))
+                    if r.noResolve {
+                        cond = "isIP && " + cond
+                    }
+                }
+        }
+        if cond == "" {
+            if r.action.Kind == routeDirect {
+                continue
+            }
+            fmt.Fprintf(&buf, "    // %s\n    return proxy;\n}\n", r.line)
+            return buf.String()
+        }
+        fmt.Fprintf(&buf, "    if (%s) return %s;\n", cond, ret(r.action))
+    }
+    fmt.Fprintf(&buf, "    return %s;\n}\n", ret(self.final))
+    return buf.String()
+}
+
+// gfwList is a list in the AutoProxy format, the domains in it go through
+// the proxy, except the exceptions.
+type gfwList struct {
+    proxyDomains []string
+    directDomains []string
+    proxyKeywords []string
+}
+
+func loadGFWList(path string) (*gfwList, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    return parseGFWList(data)
+}
+
+func parseGFWList(data []byte) (*gfwList, error) {
+    data = bytes.TrimSpace(data)
+    if !bytes.HasPrefix(data, []byte("[AutoProxy")) {
+        // Usually published in base64.
+        decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(data), nil)))
+        if err != nil {
+            return nil, fmt.Errorf("Invalid GFWList: %v", err)
+        }
+        data = decoded
+    }
+
+    self := &gfwList{}
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+            continue
+        }
+        // Regular expressions are not supported.
+        if strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+            continue
+        }
+        domains := &self.proxyDomains
+        if strings.HasPrefix(line, "@@") {
+            domains = &self.directDomains
+            line = line[2:]
+        }
+        switch {
+            case strings.HasPrefix(line, "||"):
+                line = line[2:]
+            case strings.HasPrefix(line, "|"):
+                line = line[1:]
+                if i := strings.Index(line, "://"); i >= 0 {
+                    line = line[i+3:]
+                }
+            case strings.HasPrefix(line, "."):
+                line = line[1:]
+            default:
+                if domains == &self.proxyDomains {
+                    self.proxyKeywords = append(self.proxyKeywords, line)
+                }
+                continue
+        }
+        if i := strings.IndexAny(line, "/:*^"); i >= 0 {
+            line = line[:i]
+        }
+        if line != "" {
+            *domains = append(*domains, strings.ToLower(line))
+        }
+    }
+    return self, scanner.Err()
+}
+
+func jsSet(domains []string) string {
+    set := make(map[string]int, len(domains))
+    for _, d := range domains {
+        set[d] = 1
+    }
+    b, _ := json.Marshal(set)
+    return string(b)
+}
+
+func (self *gfwList) pacScript() string {
+    keywords, _ := json.Marshal(self.proxyKeywords)
+    if self.proxyKeywords == nil {
+        keywords = []byte("[]")
+    }
+    return fmt.Sprintf(`var directDomains = %s;
+var proxyDomains = %s;
+var proxyKeywords = %s;
+
+function matchDomain(domains, host) {
+    var pos = 0;
+    while (pos >= 0) {
+        if (domains.hasOwnProperty(host.substring(pos))) {
+            return true;
+        }
+        pos = host.indexOf(".", pos);
+        if (pos >= 0) {
+            pos++;
+        }
+    }
+    return false;
+}
+
+function FindProxyForURL(url, host) {
+    host = host.toLowerCase();
+    if (matchDomain(directDomains, host)) {
+        return "DIRECT";
+    }
+    if (matchDomain(proxyDomains, host)) {
+        return proxy;
+    }
+    for (var i = 0; i < proxyKeywords.length; i++) {
+        if (shExpMatch(url, "*" + proxyKeywords[i] + "*")) {
+            return proxy;
+        }
+    }
+    return "DIRECT";
+}
+`, jsSet(self.directDomains), jsSet(self.proxyDomains), keywords)
+}
@@ -0,0 +1,98 @@
+package main
+import (
+    "os"
+    "time"
+    "strings"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/base64"
+    "net/http/httptest"
+    a "github.com/stretchr/testify/assert"
+)
+
+func TestRouterPacScript(t *testing.T) {
+    router, err := LoadRouter("testdata/rules.txt", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    script := router.pacScript()
+    a.Contains(t, script, `if (!isIP && host == "ads.example.com") return proxy;`)
+    a.Contains(t, script, `if (!isIP && (host == "example.cn" || dnsDomainIs(host, ".example.cn"))) return "DIRECT";`)
+    a.Contains(t, script, `if (isIP && isInNet(host, "192.168.0.0", "255.255.0.0")) return "DIRECT";`)
+    a.Contains(t, script, `if (isInNet(host, "127.0.0.0", "255.0.0.0")) return "DIRECT";`)
+    // The rest goes to ssplocal from the first rule which can't be checked.
+    a.Contains(t, script, "    // DST-PORT,25,REJECT\n    return proxy;\n}\n")
+    a.NotContains(t, script, "6000-6010")
+}
+
+const testGFWList = `[AutoProxy 0.2.9]
+! comment
+||google.com
+|http://blocked.example.org/path
+.twitter.com
+@@||cn.google.com
+/^https?:\/\/[^\/]+regex\.com/
+keyword.example
+`
+
+func TestParseGFWList(t *testing.T) {
+    encoded := base64.StdEncoding.EncodeToString([]byte(testGFWList))
+    for _, data := range []string{testGFWList, encoded[:40] + "\n" + encoded[40:]} {
+        list, err := parseGFWList([]byte(data))
+        if err != nil {
+            t.Fatal(err)
+        }
+        a.Equal(t, []string{"google.com", "blocked.example.org", "twitter.com"}, list.proxyDomains)
+        a.Equal(t, []string{"cn.google.com"}, list.directDomains)
+        a.Equal(t, []string{"keyword.example"}, list.proxyKeywords)
+    }
+}
+
+func TestPacServerRefresh(t *testing.T) {
+    dir, err := ioutil.TempDir("", "pac")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "rules.txt")
+    ioutil.WriteFile(path, []byte("DOMAIN-SUFFIX,first.com,DIRECT\n"), 0644)
+
+    saved := config
+    defer func() { config = saved }()
+    config = &Config{LocalAddr: "0.0.0.0:1080"}
+    rules, err := LoadRouterFile(path, nil, config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    rules.interval = 0
+    server, err := NewPacServer(rules, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    get := func() string {
+        w := httptest.NewRecorder()
+        server.ServeHTTP(w, httptest.NewRequest("GET", "http://192.168.1.2:8090/proxy.pac", nil))
+        return w.Body.String()
+    }
+    script := get()
+    a.True(t, strings.HasPrefix(script, `var proxy = "SOCKS5 192.168.1.2:1080; SOCKS 192.168.1.2:1080";`))
+    a.Contains(t, script, "first.com")
+
+    ioutil.WriteFile(path, []byte("DOMAIN-SUFFIX,second.com,DIRECT\n"), 0644)
+    later := time.Now().Add(time.Second)
+    os.Chtimes(path, later, later)
+    script = get()
+    a.Contains(t, script, "second.com")
+    a.NotContains(t, script, "first.com")
+    // Connections are routed by the same rules.
+    a.Equal(t, "DIRECT", rules.Router().Route("www.second.com:443").String())
+    a.Equal(t, "PROXY", rules.Router().Route("www.first.com:443").String())
+
+    // A broken file keeps the last rules.
+    ioutil.WriteFile(path, []byte("DOMAIN-SUFFIX,third.com\n"), 0644)
+    later = later.Add(time.Second)
+    os.Chtimes(path, later, later)
+    a.Contains(t, get(), "second.com")
+    a.Equal(t, "DIRECT", rules.Router().Route("www.second.com:443").String())
+}
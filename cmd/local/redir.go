@@ -0,0 +1,60 @@
+package main
+import (
+    "net"
+    "errors"
+    "context"
+    "strconv"
+    log "github.com/Sirupsen/logrus"
+)
+
+var (
+    errRedirConn = errors.New("Not found the original destination of the connection.")
+)
+
+// ipRawAddr returns the address in the ATYP format of socks5 requests.
+func ipRawAddr(addr *net.TCPAddr) []byte {
+    const (
+        typeIPv4 = 1
+        typeIPv6 = 4
+    )
+    var rawaddr []byte
+    if ip4 := addr.IP.To4(); ip4 != nil {
+        rawaddr = append([]byte{typeIPv4}, ip4...)
+    } else {
+        rawaddr = append([]byte{typeIPv6}, addr.IP.To16()...)
+    }
+    return append(rawaddr, byte(addr.Port>>8), byte(addr.Port))
+}
+
+// listenRedir listens for the connections redirected by iptables REDIRECT,
+// or TPROXY.
+func listenRedir(listenAddr string, tproxy bool) (net.Listener, error) {
+    lc := net.ListenConfig{Control: redirControl(tproxy)}
+    return lc.Listen(context.Background(), "tcp", listenAddr)
+}
+
+func handleRedirConnection(l *Listener, conn net.Conn) {
+    tproxy := l.config.RedirMode == "tproxy"
+    dst, err := originalDst(conn, tproxy)
+    if err != nil {
+        log.Warning("error getting original destination:", err)
+        conn.Close()
+        return
+    }
+    // Connections made to the listener itself would loop forever.
+    if local, ok := conn.LocalAddr().(*net.TCPAddr); !tproxy && ok && local.IP.Equal(dst.IP) && local.Port == dst.Port {
+        log.WithField("addr", dst).Warning("Refuse connection to the redir listener itself.")
+        conn.Close()
+        return
+    }
+
+    addr := net.JoinHostPort(dst.IP.String(), strconv.Itoa(dst.Port))
+    remote, err := dialRemote(l, nil, ipRawAddr(dst), addr)
+    if err != nil {
+        log.Debugf("error when create connection to server: %v\n", err)
+        conn.Close()
+        return
+    }
+    log.WithField("addr", addr).Infof("Proxy redirected connection to %v", addr)
+    relayConn(conn, remote)
+}
@@ -0,0 +1,95 @@
+package main
+import (
+    "net"
+    "syscall"
+    "unsafe"
+    "encoding/binary"
+)
+
+const (
+    // From linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h.
+    soOriginalDst = 80
+    ip6tSoOriginalDst = 80
+)
+
+// redirControl sets IP_TRANSPARENT on the listener of TPROXY, so that it
+// accepts connections to any address.
+func redirControl(tproxy bool) func(network, address string, c syscall.RawConn) error {
+    if !tproxy {
+        return nil
+    }
+    return func(network, address string, c syscall.RawConn) error {
+        var err error
+        if ctrlErr := c.Control(func(fd uintptr) {
+            if err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+                return
+            }
+            if network != "tcp4" {
+                // IPV6_TRANSPARENT from linux/in6.h.
+                err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, 75, 1)
+            }
+        }); ctrlErr != nil {
+            return ctrlErr
+        }
+        return err
+    }
+}
+
+// originalDst returns the destination of a connection before it's redirected
+// by iptables. With TPROXY, it's the local address of the connection.
+func originalDst(conn net.Conn, tproxy bool) (*net.TCPAddr, error) {
+    tcpConn, ok := conn.(*net.TCPConn)
+    if !ok {
+        return nil, errRedirConn
+    }
+    if tproxy {
+        return tcpConn.LocalAddr().(*net.TCPAddr), nil
+    }
+    rawConn, err := tcpConn.SyscallConn()
+    if err != nil {
+        return nil, err
+    }
+
+    var addr *net.TCPAddr
+    var sockErr error
+    err = rawConn.Control(func(fd uintptr) {
+        if tcpConn.LocalAddr().(*net.TCPAddr).IP.To4() != nil {
+            // sockaddr_in fits in the ipv6_mreq returned.
+            var mreq *syscall.IPv6Mreq
+            if mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); sockErr != nil {
+                return
+            }
+            addr = sockaddrInAddr(&mreq.Multiaddr)
+        } else {
+            // sockaddr_in6 is at the beginning of the ip6_mtuinfo returned.
+            var info *syscall.IPv6MTUInfo
+            if info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst); sockErr != nil {
+                return
+            }
+            addr = sockaddrIn6Addr(&info.Addr)
+        }
+    })
+    if err != nil {
+        return nil, err
+    }
+    return addr, sockErr
+}
+
+// sockaddrInAddr decodes a struct sockaddr_in, whose port and address are in
+// network byte order.
+func sockaddrInAddr(sa *[16]byte) *net.TCPAddr {
+    return &net.TCPAddr{
+        IP: net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+        Port: int(binary.BigEndian.Uint16(sa[2:4])),
+    }
+}
+
+// sockaddrIn6Addr decodes a struct sockaddr_in6, whose port is in network byte
+// order though the field is an uint16 of the host.
+func sockaddrIn6Addr(sa *syscall.RawSockaddrInet6) *net.TCPAddr {
+    port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+    return &net.TCPAddr{
+        IP: net.IP(append([]byte(nil), sa.Addr[:]...)),
+        Port: int(binary.BigEndian.Uint16(port[:])),
+    }
+}
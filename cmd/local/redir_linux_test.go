@@ -0,0 +1,94 @@
+package main
+import (
+    "os"
+    "net"
+    "testing"
+    "syscall"
+    "unsafe"
+    "os/exec"
+    "strconv"
+    a "github.com/stretchr/testify/assert"
+)
+
+func TestSockaddrAddr(t *testing.T) {
+    // sockaddr_in of 192.0.2.1:8080, the family in host byte order.
+    sa := [16]byte{syscall.AF_INET, 0, 0x1f, 0x90, 192, 0, 2, 1}
+    a.Equal(t, "192.0.2.1:8080", sockaddrInAddr(&sa).String())
+
+    sa6 := &syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+    copy(sa6.Addr[:], net.ParseIP("2001:db8::1"))
+    *(*[2]byte)(unsafe.Pointer(&sa6.Port)) = [2]byte{0x01, 0xbb}
+    a.Equal(t, "[2001:db8::1]:443", sockaddrIn6Addr(sa6).String())
+}
+
+// TestRedirNetns runs itself again as root in a network namespace, where it
+// may set up iptables without touching the host.
+func TestRedirNetns(t *testing.T) {
+    if os.Getenv("REDIR_NETNS") == "" {
+        if os.Geteuid() != 0 {
+            t.Skip("network namespace requires root")
+        }
+        if err := exec.Command("unshare", "-n", "true").Run(); err != nil {
+            t.Skip("network namespace unavailable:", err)
+        }
+        cmd := exec.Command("unshare", "-n", "sh", "-c", `ip link set lo up && exec "$0" -test.run '^TestRedirNetns$' -test.v`, os.Args[0])
+        cmd.Env = append(os.Environ(), "REDIR_NETNS=1")
+        out, err := cmd.CombinedOutput()
+        t.Logf("%s", out)
+        if err != nil {
+            t.Fatal("test in network namespace failed:", err)
+        }
+        return
+    }
+
+    t.Run("tproxy", func(t *testing.T) {
+        ln, err := listenRedir("127.0.0.1:0", true)
+        if err != nil {
+            t.Fatal("error listening with IP_TRANSPARENT:", err)
+        }
+        defer ln.Close()
+        client, err := net.Dial("tcp", ln.Addr().String())
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer client.Close()
+        conn, err := ln.Accept()
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+        dst, err := originalDst(conn, true)
+        a.Nil(t, err)
+        a.Equal(t, ln.Addr().String(), dst.String())
+    })
+
+    t.Run("redirect", func(t *testing.T) {
+        if _, err := exec.LookPath("iptables"); err != nil {
+            t.Skip("iptables not found")
+        }
+        ln, err := listenRedir("127.0.0.1:0", false)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer ln.Close()
+        port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+        out, err := exec.Command("iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", "127.0.0.1",
+            "--dport", "8000", "-j", "REDIRECT", "--to-ports", port).CombinedOutput()
+        if err != nil {
+            t.Skipf("error adding REDIRECT rule: %v %s", err, out)
+        }
+        client, err := net.Dial("tcp", "127.0.0.1:8000")
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer client.Close()
+        conn, err := ln.Accept()
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+        dst, err := originalDst(conn, false)
+        a.Nil(t, err)
+        a.Equal(t, "127.0.0.1:8000", dst.String())
+    })
+}
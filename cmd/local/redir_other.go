@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+import (
+    "net"
+    "errors"
+    "syscall"
+)
+
+func redirControl(tproxy bool) func(network, address string, c syscall.RawConn) error {
+    return func(network, address string, c syscall.RawConn) error {
+        return errors.New("redir is only supported on linux")
+    }
+}
+
+func originalDst(conn net.Conn, tproxy bool) (*net.TCPAddr, error) {
+    return nil, errRedirConn
+}
@@ -0,0 +1,20 @@
+package main
+import (
+    "net"
+    "testing"
+    a "github.com/stretchr/testify/assert"
+)
+
+func TestIPRawAddr(t *testing.T) {
+    cases := []struct {
+        addr *net.TCPAddr
+        expected []byte
+    }{
+        {&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}, []byte{1, 192, 0, 2, 1, 1, 187}},
+        {&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 8080}, []byte{1, 10, 0, 0, 1, 0x1f, 0x90}},
+        {&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 65535}, []byte{4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff}},
+    }
+    for _, c := range cases {
+        a.Equal(t, c.expected, ipRawAddr(c.addr), c.addr.String())
+    }
+}
@@ -0,0 +1,379 @@
+package main
+import (
+    "os"
+    "io"
+    "net"
+    "bufio"
+    "errors"
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    log "github.com/Sirupsen/logrus"
+)
+
+var (
+    errRejected = errors.New("Connection rejected by routing rules.")
+)
+
+// lookupIP resolves domains for the IP rules, replaced in tests.
+var lookupIP = net.LookupIP
+
+const (
+    // Through the server of the user, or the first server.
+    routeProxy = iota
+    routeDirect
+    routeReject
+    // Through the server named by RouteAction.Server.
+    routeServer
+)
+
+type RouteAction struct {
+    Kind int
+    Server string
+}
+
+func (a RouteAction) String() string {
+    switch a.Kind {
+        case routeDirect:
+            return "DIRECT"
+        case routeReject:
+            return "REJECT"
+        case routeServer:
+            return a.Server
+    }
+    return "PROXY"
+}
+
+func parseRouteAction(s string) RouteAction {
+    switch strings.ToUpper(s) {
+        case "PROXY":
+            return RouteAction{Kind: routeProxy}
+        case "DIRECT":
+            return RouteAction{Kind: routeDirect}
+        case "REJECT":
+            return RouteAction{Kind: routeReject}
+    }
+    return RouteAction{Kind: routeServer, Server: s}
+}
+
+// destination is the address being routed, its IPs are only resolved when a
+// rule needs them.
+type destination struct {
+    host string
+    port int
+    ip net.IP
+
+    resolved bool
+    ips []net.IP
+}
+
+func newDestination(addr string) (*destination, error) {
+    host, portStr, err := net.SplitHostPort(addr)
+    if err != nil {
+        return nil, err
+    }
+    port, err := strconv.Atoi(portStr)
+    if err != nil {
+        return nil, err
+    }
+    d := &destination{host: strings.ToLower(strings.TrimSuffix(host, ".")), port: port}
+    d.ip = net.ParseIP(host)
+    return d, nil
+}
+
+func (d *destination) isDomain() bool {
+    return d.ip == nil
+}
+
+func (d *destination) IPs() []net.IP {
+    if d.ip != nil {
+        return []net.IP{d.ip}
+    }
+    if !d.resolved {
+        d.resolved = true
+        ips, err := lookupIP(d.host)
+        if err != nil {
+            log.WithField("host", d.host).Debug("Resolve for routing failed: ", err)
+        }
+        d.ips = ips
+    }
+    return d.ips
+}
+
+type rule struct {
+    line string
+    kind string
+    value string
+    noResolve bool
+    match func(d *destination) bool
+    action RouteAction
+}
+
+// Router picks the action for destinations with the first matching rule of a
+// rules file. Each line is TYPE,VALUE,ACTION, where TYPE is one of
+// DOMAIN, DOMAIN-SUFFIX, DOMAIN-KEYWORD, DOMAIN-REGEX, IP-CIDR, GEOIP or
+// DST-PORT, and ACTION is PROXY, DIRECT, REJECT or the name of a server.
+// IP-CIDR and GEOIP rules resolve domains unless followed by ",no-resolve".
+// The line FINAL,ACTION sets the action if no rule matches, which is PROXY by
+// default.
+type Router struct {
+    rules []*rule
+    final RouteAction
+}
+
+// LoadRouter loads the rules file, geoip is needed by GEOIP rules only.
+func LoadRouter(path string, geoip GeoIP) (*Router, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    return parseRules(file, geoip)
+}
+
+// RouterFile keeps the router of a rules file, which is loaded again when the
+// file is modified. The connections and the PAC script share it, so that they
+// route by the same rules. The servers of the rules must be in the config.
+type RouterFile struct {
+    path string
+    geoip GeoIP
+    config *Config
+    // How often the file is checked for modifications.
+    interval time.Duration
+
+    mutex sync.RWMutex
+    checked time.Time
+    modTime time.Time
+    router *Router
+}
+
+func LoadRouterFile(path string, geoip GeoIP, c *Config) (*RouterFile, error) {
+    stat, err := os.Stat(path)
+    if err != nil {
+        return nil, err
+    }
+    router, err := LoadRouter(path, geoip)
+    if err == nil {
+        err = router.Validate(c)
+    }
+    if err != nil {
+        return nil, err
+    }
+    self := &RouterFile{
+        path: path,
+        geoip: geoip,
+        config: c,
+        interval: time.Second,
+        checked: time.Now(),
+        modTime: stat.ModTime(),
+        router: router,
+    }
+    return self, nil
+}
+
+// Router returns the current router. A modified file which fails to load is
+// logged, and the last router is kept.
+func (self *RouterFile) Router() *Router {
+    self.mutex.RLock()
+    router := self.router
+    fresh := time.Since(self.checked) < self.interval
+    self.mutex.RUnlock()
+    if fresh {
+        return router
+    }
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+    if time.Since(self.checked) < self.interval {
+        return self.router
+    }
+    self.checked = time.Now()
+    stat, err := os.Stat(self.path)
+    if err != nil || stat.ModTime().Equal(self.modTime) {
+        return self.router
+    }
+    // Not retried until modified again.
+    self.modTime = stat.ModTime()
+    if router, err = LoadRouter(self.path, self.geoip); err == nil {
+        err = router.Validate(self.config)
+    }
+    if err != nil {
+        log.WithFields(log.Fields{"file": self.path, "error": err}).Warning("Reload routing rules failed.")
+        return self.router
+    }
+    self.router = router
+    log.WithField("file", self.path).Info("Reloaded routing rules.")
+    return router
+}
+
+func parseRules(r io.Reader, geoip GeoIP) (*Router, error) {
+    self := &Router{final: RouteAction{Kind: routeProxy}}
+    scanner := bufio.NewScanner(r)
+    lineNo := 0
+    for scanner.Scan() {
+        lineNo++
+        line := scanner.Text()
+        if i := strings.IndexByte(line, '#'); i >= 0 {
+            line = line[:i]
+        }
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+        fields := strings.Split(line, ",")
+        for i := range fields {
+            fields[i] = strings.TrimSpace(fields[i])
+        }
+        if strings.ToUpper(fields[0]) == "FINAL" {
+            if len(fields) != 2 {
+                return nil, fmt.Errorf("Invalid rule at line %v: %v", lineNo, line)
+            }
+            self.final = parseRouteAction(fields[1])
+            continue
+        }
+        rule, err := parseRule(fields, geoip)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid rule at line %v: %v", lineNo, err)
+        }
+        rule.line = line
+        self.rules = append(self.rules, rule)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    return self, nil
+}
+
+func parseRule(fields []string, geoip GeoIP) (*rule, error) {
+    if len(fields) < 3 {
+        return nil, fmt.Errorf("should be TYPE,VALUE,ACTION")
+    }
+    kind, value := strings.ToUpper(fields[0]), fields[1]
+    options := fields[3:]
+    r := &rule{kind: kind, value: value, action: parseRouteAction(fields[2])}
+    for _, opt := range options {
+        if strings.ToLower(opt) == "no-resolve" {
+            r.noResolve = true
+        }
+    }
+    switch kind {
+        case "DOMAIN":
+            value = strings.ToLower(value)
+            r.match = func(d *destination) bool {
+                return d.isDomain() && d.host == value
+            }
+        case "DOMAIN-SUFFIX":
+            value = strings.ToLower(strings.TrimPrefix(value, "."))
+            r.match = func(d *destination) bool {
+                return d.isDomain() && (d.host == value || strings.HasSuffix(d.host, "."+value))
+            }
+        case "DOMAIN-KEYWORD":
+            value = strings.ToLower(value)
+            r.match = func(d *destination) bool {
+                return d.isDomain() && strings.Contains(d.host, value)
+            }
+        case "DOMAIN-REGEX":
+            re, err := regexp.Compile(value)
+            if err != nil {
+                return nil, err
+            }
+            r.match = func(d *destination) bool {
+                return d.isDomain() && re.MatchString(d.host)
+            }
+        case "IP-CIDR", "IP-CIDR6":
+            _, ipnet, err := net.ParseCIDR(value)
+            if err != nil {
+                return nil, err
+            }
+            r.match = ipRuleMatcher(r.noResolve, ipnet.Contains)
+        case "GEOIP":
+            if geoip == nil {
+                return nil, fmt.Errorf("GEOIP rules need a GeoIP database")
+            }
+            country := strings.ToUpper(value)
+            r.match = ipRuleMatcher(r.noResolve, func(ip net.IP) bool {
+                return geoip.Country(ip) == country
+            })
+        case "DST-PORT":
+            min, max, err := parsePortRange(value)
+            if err != nil {
+                return nil, err
+            }
+            r.match = func(d *destination) bool {
+                return d.port >= min && d.port <= max
+            }
+        default:
+            return nil, fmt.Errorf("unknown rule type %v", fields[0])
+    }
+    return r, nil
+}
+
+// ipRuleMatcher matches the IPs of destinations, domains are resolved unless
+// noResolve.
+func ipRuleMatcher(noResolve bool, contains func(ip net.IP) bool) func(d *destination) bool {
+    return func(d *destination) bool {
+        if d.isDomain() && noResolve {
+            return false
+        }
+        for _, ip := range d.IPs() {
+            if contains(ip) {
+                return true
+            }
+        }
+        return false
+    }
+}
+
+// parsePortRange parses a port, or a range of ports like 8000-9000.
+func parsePortRange(s string) (min, max int, err error) {
+    parts := strings.SplitN(s, "-", 2)
+    if min, err = strconv.Atoi(parts[0]); err != nil {
+        return
+    }
+    max = min
+    if len(parts) == 2 {
+        if max, err = strconv.Atoi(parts[1]); err != nil {
+            return
+        }
+    }
+    if min < 0 || max > 65535 || min > max {
+        err = fmt.Errorf("invalid port range %v", s)
+    }
+    return
+}
+
+// Validate checks that the servers named by the actions are in the config.
+func (self *Router) Validate(c *Config) error {
+    for _, action := range append([]RouteAction{self.final}, self.actions()...) {
+        if action.Kind == routeServer && c.FindServer(action.Server) == nil {
+            return fmt.Errorf("Unknown action or server %q of routing rules", action.Server)
+        }
+    }
+    return nil
+}
+
+func (self *Router) actions() []RouteAction {
+    actions := make([]RouteAction, len(self.rules))
+    for i, r := range self.rules {
+        actions[i] = r.action
+    }
+    return actions
+}
+
+// Route returns the action for addr in host:port format.
+func (self *Router) Route(addr string) RouteAction {
+    d, err := newDestination(addr)
+    if err != nil {
+        return self.final
+    }
+    for _, r := range self.rules {
+        if r.match(d) {
+            log.WithFields(log.Fields{"addr": addr, "rule": r.line}).Debug("Matched routing rule.")
+            return r.action
+        }
+    }
+    return self.final
+}
@@ -0,0 +1,87 @@
+package main
+import (
+    "net"
+    "strings"
+    "testing"
+    a "github.com/stretchr/testify/assert"
+)
+
+func TestRouter(t *testing.T) {
+    router, err := LoadRouter("testdata/rules.txt", nil)
+    if err != nil {
+        t.Fatal("error loading rules:", err)
+    }
+    defer func(saved func(string) ([]net.IP, error)) { lookupIP = saved }(lookupIP)
+    lookupIP = func(host string) ([]net.IP, error) {
+        if host == "db.internal" {
+            return []net.IP{net.ParseIP("127.0.0.5")}, nil
+        }
+        return nil, &net.DNSError{Err: "no such host", Name: host}
+    }
+    cases := map[string]string{
+        "ads.example.com:443":    "REJECT",
+        "www.example.cn:80":      "DIRECT",
+        "example.cn:80":          "DIRECT",
+        "notexample.cn:80":       "PROXY",
+        "www.Video.com:443":      "us-server",
+        "mail12.example.com:993": "DIRECT",
+        "192.168.1.1:22":         "DIRECT",
+        "127.0.0.1:8080":         "DIRECT",
+        "db.internal:8080":       "DIRECT",
+        "unknown.internal:8080":  "PROXY",
+        "10.0.0.1:25":            "REJECT",
+        "10.0.0.1:6005":          "DIRECT",
+        "10.0.0.1:6011":          "PROXY",
+    }
+    for addr, action := range cases {
+        a.Equal(t, action, router.Route(addr).String(), addr)
+    }
+}
+
+func TestRouterValidate(t *testing.T) {
+    router, err := LoadRouter("testdata/rules.txt", nil)
+    if err != nil {
+        t.Fatal("error loading rules:", err)
+    }
+    c := &Config{Servers: []*ServerEndpointConfig{{Name: "us-server"}}}
+    a.Nil(t, router.Validate(c))
+    c.Servers[0].Name = "jp-server"
+    a.NotNil(t, router.Validate(c))
+
+    router, err = parseRules(strings.NewReader("DOMAIN,example.com,DIRCET\n"), nil)
+    a.Nil(t, err)
+    a.NotNil(t, router.Validate(c), "typo of an action not found")
+}
+
+func TestParseRulesError(t *testing.T) {
+    _, err := parseRules(strings.NewReader("DOMAIN-SUFFIX,example.com\n"), nil)
+    a.NotNil(t, err)
+    _, err = parseRules(strings.NewReader("UNKNOWN,example.com,DIRECT\n"), nil)
+    a.NotNil(t, err)
+    _, err = parseRules(strings.NewReader("DST-PORT,9000-8000,DIRECT\n"), nil)
+    a.NotNil(t, err)
+}
+
+func TestGeoIPRules(t *testing.T) {
+    geoip, err := LoadGeoIP("testdata/geoip.txt")
+    if err != nil {
+        t.Fatal("error loading geoip:", err)
+    }
+    a.Equal(t, "CN", geoip.Country(net.ParseIP("1.0.1.1")))
+    a.Equal(t, "CN", geoip.Country(net.ParseIP("1.0.3.255")))
+    a.Equal(t, "", geoip.Country(net.ParseIP("1.0.4.0")))
+    a.Equal(t, "JP", geoip.Country(net.ParseIP("2001:268::1")))
+    a.Equal(t, "", geoip.Country(net.ParseIP("8.8.8.8")))
+
+    rules := "GEOIP,cn,DIRECT,no-resolve\nGEOIP,JP,REJECT\n"
+    router, err := parseRules(strings.NewReader(rules), geoip)
+    if err != nil {
+        t.Fatal(err)
+    }
+    a.Equal(t, "DIRECT", router.Route("1.0.2.3:443").String())
+    a.Equal(t, "REJECT", router.Route("[2001:268::1]:443").String())
+    a.Equal(t, "PROXY", router.Route("8.8.8.8:53").String())
+
+    _, err = parseRules(strings.NewReader(rules), nil)
+    a.NotNil(t, err)
+}
@@ -0,0 +1,101 @@
+package main
+import (
+    "errors"
+    "net"
+    "io"
+    "bufio"
+    "encoding/binary"
+    "strconv"
+)
+
+const (
+    socksVer4 = 4
+
+    socks4ReplyVer      = 0
+    socks4ReplyGranted  = 90
+    socks4ReplyRejected = 91
+)
+
+var (
+    errSocks4Field = errors.New("socks4 request field too long")
+)
+
+// readSocks4String reads a NUL terminated field of at most 255 bytes.
+func readSocks4String(r *bufio.Reader) (string, error) {
+    var field []byte
+    for {
+        b, err := r.ReadByte()
+        if err != nil {
+            return "", err
+        }
+        if b == 0 {
+            return string(field), nil
+        }
+        if len(field) >= 255 {
+            return "", errSocks4Field
+        }
+        field = append(field, b)
+    }
+}
+
+// getSocks4Request reads a SOCKS4 or SOCKS4a CONNECT request, and returns the
+// destination in the ATYP format of socks5 requests.
+func getSocks4Request(r *bufio.Reader) (rawaddr []byte, host string, err error) {
+    const (
+        idVer  = 0
+        idCmd  = 1
+        idPort = 2
+        idIP0  = 4
+
+        typeIPv4 = 1
+        typeDm   = 3
+    )
+    // ver + cmd + port + ip
+    buf := make([]byte, 8)
+    if _, err = io.ReadFull(r, buf); err != nil {
+        return
+    }
+    if buf[idVer] != socksVer4 {
+        err = errVer
+        return
+    }
+    if buf[idCmd] != socksCmdConnect {
+        err = errCmd
+        return
+    }
+    // The user id is not used.
+    if _, err = readSocks4String(r); err != nil {
+        return
+    }
+
+    port := buf[idPort : idPort+2]
+    ip := buf[idIP0 : idIP0+net.IPv4len]
+    // SOCKS4a, an ip of 0.0.0.x with x non-zero means a domain name follows.
+    if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+        if host, err = readSocks4String(r); err != nil {
+            return
+        }
+        if host == "" {
+            err = errAddrType
+            return
+        }
+        rawaddr = make([]byte, 0, 1+1+len(host)+2)
+        rawaddr = append(rawaddr, typeDm, byte(len(host)))
+        rawaddr = append(rawaddr, host...)
+        rawaddr = append(rawaddr, port...)
+    } else {
+        host = net.IP(ip).String()
+        rawaddr = make([]byte, 0, 1+net.IPv4len+2)
+        rawaddr = append(rawaddr, typeIPv4)
+        rawaddr = append(rawaddr, ip...)
+        rawaddr = append(rawaddr, port...)
+    }
+    host = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+    return
+}
+
+// socks4Reply builds a reply, the port and ip are ignored by the clients of
+// CONNECT requests.
+func socks4Reply(code byte) []byte {
+    return []byte{socks4ReplyVer, code, 0, 0, 0, 0, 0, 0}
+}
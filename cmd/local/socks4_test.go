@@ -0,0 +1,52 @@
+package main
+import (
+    "io"
+    "bufio"
+    "strings"
+    "testing"
+    a "github.com/stretchr/testify/assert"
+)
+
+func TestGetSocks4Request(t *testing.T) {
+    cases := []struct {
+        name string
+        request string
+        rawaddr []byte
+        host string
+        err error
+    }{
+        {"ipv4", "\x04\x01\x00\x50\x0a\x00\x00\x01alice\x00",
+            []byte{1, 10, 0, 0, 1, 0, 0x50}, "10.0.0.1:80", nil},
+        {"socks4a hostname", "\x04\x01\x01\xbb\x00\x00\x00\x01alice\x00example.com\x00",
+            append([]byte{3, 11}, "example.com\x01\xbb"...), "example.com:443", nil},
+        {"socks4a empty hostname", "\x04\x01\x01\xbb\x00\x00\x00\x01\x00\x00", nil, "", errAddrType},
+        {"unspecified ip", "\x04\x01\x00\x50\x00\x00\x00\x00\x00",
+            []byte{1, 0, 0, 0, 0, 0, 0x50}, "0.0.0.0:80", nil},
+        {"missing userid terminator", "\x04\x01\x00\x50\x0a\x00\x00\x01alice", nil, "", io.EOF},
+        {"missing hostname terminator", "\x04\x01\x01\xbb\x00\x00\x00\x01\x00example.com", nil, "", io.EOF},
+        {"overlong userid", "\x04\x01\x00\x50\x0a\x00\x00\x01" + strings.Repeat("u", 256) + "\x00", nil, "", errSocks4Field},
+        {"overlong hostname", "\x04\x01\x00\x50\x00\x00\x00\x01\x00" + strings.Repeat("h", 256) + "\x00", nil, "", errSocks4Field},
+        {"bind", "\x04\x02\x00\x50\x0a\x00\x00\x01\x00", nil, "", errCmd},
+        {"socks5", "\x05\x01\x00\x50\x0a\x00\x00\x01\x00", nil, "", errVer},
+    }
+    for _, c := range cases {
+        rawaddr, host, err := getSocks4Request(bufio.NewReader(strings.NewReader(c.request)))
+        if c.err != nil {
+            a.Equal(t, c.err, err, c.name)
+            continue
+        }
+        a.Nil(t, err, c.name)
+        a.Equal(t, c.rawaddr, rawaddr, c.name)
+        a.Equal(t, c.host, host, c.name)
+    }
+
+    // The longest userid allowed.
+    _, host, err := getSocks4Request(bufio.NewReader(strings.NewReader("\x04\x01\x00\x50\x0a\x00\x00\x01" + strings.Repeat("u", 255) + "\x00")))
+    a.Nil(t, err)
+    a.Equal(t, "10.0.0.1:80", host)
+}
+
+func TestSocks4Reply(t *testing.T) {
+    a.Equal(t, []byte{0, 90, 0, 0, 0, 0, 0, 0}, socks4Reply(socks4ReplyGranted))
+    a.Equal(t, []byte{0, 91, 0, 0, 0, 0, 0, 0}, socks4Reply(socks4ReplyRejected))
+}
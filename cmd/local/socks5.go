@@ -3,28 +3,48 @@ import (
     "errors"
     "net"
     "io"
-    "time"
     "encoding/binary"
     "strconv"
+    "syscall"
+    ss "bitbucket.org/qiuyuzhou/shadowsocks/core"
 )
 
 const (
     socksVer5       = 5
     socksCmdConnect = 1
+
+    socksMethodNoAuth       = 0
+    socksMethodUserPass     = 2
+    socksMethodNoAcceptable = 0xff
+
+    // reply codes, RFC 1928 section 6
+    socksRepSucceeded          = 0
+    socksRepGeneralFailure     = 1
+    socksRepNotAllowed         = 2
+    socksRepNetUnreachable     = 3
+    socksRepHostUnreachable    = 4
+    socksRepConnectionRefused  = 5
+    socksRepTTLExpired         = 6
+    socksRepCmdNotSupported    = 7
+    socksRepAddrNotSupported   = 8
+
+    socksAuthVer     = 1
+    socksAuthSuccess = 0
+    socksAuthFailure = 1
 )
 
 var (
     errAddrType      = errors.New("socks addr type not supported")
     errVer           = errors.New("socks version not supported")
-    errMethod        = errors.New("socks only support 1 method now")
+    errMethod        = errors.New("socks no acceptable authentication method")
+    errAuthVer       = errors.New("socks authentication version not supported")
+    errAuthFailed    = errors.New("socks authentication failed")
     errAuthExtraData = errors.New("socks authentication get extra data")
     errReqExtraData  = errors.New("socks request get extra data")
     errCmd           = errors.New("socks command not supported")
 )
 
-var readTimeout time.Duration = 300
-
-func handShake(conn net.Conn) (err error) {
+func handShake(l *Listener, conn net.Conn) (user *LocalUserConfig, err error) {
     const (
         idVer     = 0
         idNmethod = 1
@@ -37,13 +57,12 @@ func handShake(conn net.Conn) (err error) {
     buf := make([]byte, 258)
 
     var n int
-//    conn.SetReadDeadline(time.Now().Add(readTimeout))
     // make sure we get the nmethod field
     if n, err = io.ReadAtLeast(conn, buf, idNmethod+1); err != nil {
         return
     }
     if buf[idVer] != socksVer5 {
-        return errVer
+        return nil, errVer
     }
     nmethod := int(buf[idNmethod])
     msgLen := nmethod + 2
@@ -54,10 +73,61 @@ func handShake(conn net.Conn) (err error) {
             return
         }
     } else { // error, should not get extra data
-        return errAuthExtraData
+        return nil, errAuthExtraData
+    }
+
+    // pick the method required by the config from what the client offers
+    method := byte(socksMethodNoAuth)
+    if l.AuthRequired() {
+        method = socksMethodUserPass
+    }
+    offered := false
+    for _, m := range buf[idNmethod+1 : msgLen] {
+        if m == method {
+            offered = true
+            break
+        }
+    }
+    if !offered {
+        conn.Write([]byte{socksVer5, socksMethodNoAcceptable})
+        return nil, errMethod
+    }
+    if _, err = conn.Write([]byte{socksVer5, method}); err != nil {
+        return
+    }
+    if method == socksMethodUserPass {
+        return authUserPass(l, conn)
     }
-    // send confirmation: version 5, no authentication required
-    _, err = conn.Write([]byte{socksVer5, 0})
+    return
+}
+
+// authUserPass does the username/password sub-negotiation in RFC 1929.
+func authUserPass(l *Listener, conn net.Conn) (user *LocalUserConfig, err error) {
+    // ver + ulen + uname(at most 255) + plen + passwd(at most 255)
+    buf := make([]byte, 513)
+    if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+        return
+    }
+    if buf[0] != socksAuthVer {
+        return nil, errAuthVer
+    }
+    ulen := int(buf[1])
+    if _, err = io.ReadFull(conn, buf[2:2+ulen+1]); err != nil {
+        return
+    }
+    plen := int(buf[2+ulen])
+    if _, err = io.ReadFull(conn, buf[3+ulen:3+ulen+plen]); err != nil {
+        return
+    }
+    username := string(buf[2 : 2+ulen])
+    password := string(buf[3+ulen : 3+ulen+plen])
+
+    user = l.Authenticate(username, password)
+    if user == nil {
+        conn.Write([]byte{socksAuthVer, socksAuthFailure})
+        return nil, errAuthFailed
+    }
+    _, err = conn.Write([]byte{socksAuthVer, socksAuthSuccess})
     return
 }
 
@@ -81,7 +151,6 @@ func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
     // refer to getRequest in server.go for why set buffer size to 263
     buf := make([]byte, 263)
     var n int
-//    conn.SetReadDeadline(time.Now().Add(readTimeout))
     // read till we get possible domain length field
     if n, err = io.ReadAtLeast(conn, buf, idDmLen+1); err != nil {
         return
@@ -135,3 +204,64 @@ func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
 
     return
 }
+
+// socksReply builds a reply with the bound address, which is 0.0.0.0:0 if
+// unknown.
+func socksReply(rep byte, bound net.Addr) []byte {
+    const (
+        typeIPv4 = 1
+        typeIPv6 = 4
+    )
+    ip := net.IPv4zero.To4()
+    port := 0
+    if addr, ok := bound.(*net.TCPAddr); ok && addr.IP != nil {
+        ip = addr.IP
+        if ip4 := ip.To4(); ip4 != nil {
+            ip = ip4
+        }
+        port = addr.Port
+    }
+    buf := make([]byte, 0, 4+net.IPv6len+2)
+    buf = append(buf, socksVer5, rep, 0)
+    if len(ip) == net.IPv4len {
+        buf = append(buf, typeIPv4)
+    } else {
+        buf = append(buf, typeIPv6)
+    }
+    buf = append(buf, ip...)
+    return append(buf, byte(port>>8), byte(port))
+}
+
+// socksReplyCode maps the error of a request or connecting to a reply code.
+// The errors of the destination are only known if the server sends the
+// connect status.
+func socksReplyCode(err error) byte {
+    switch {
+        case err == ss.ErrConnectRefused:
+            return socksRepConnectionRefused
+        case err == ss.ErrHostUnreachable, err == ss.ErrDNSFailure:
+            return socksRepHostUnreachable
+        case err == ss.ErrConnectDenied, err == errRejected:
+            return socksRepNotAllowed
+        case err == ss.ErrConnectFailed:
+            return socksRepGeneralFailure
+        case err == errCmd:
+            return socksRepCmdNotSupported
+        case err == errAddrType:
+            return socksRepAddrNotSupported
+        case errors.Is(err, syscall.ECONNREFUSED):
+            return socksRepConnectionRefused
+        case errors.Is(err, syscall.ENETUNREACH):
+            return socksRepNetUnreachable
+        case errors.Is(err, syscall.EHOSTUNREACH):
+            return socksRepHostUnreachable
+    }
+    var dnsErr *net.DNSError
+    if errors.As(err, &dnsErr) {
+        return socksRepHostUnreachable
+    }
+    if ne, ok := err.(net.Error); ok && ne.Timeout() {
+        return socksRepTTLExpired
+    }
+    return socksRepGeneralFailure
+}
@@ -0,0 +1,29 @@
+package main
+import (
+    "net"
+    "os"
+    "errors"
+    "syscall"
+    "testing"
+    a "github.com/stretchr/testify/assert"
+    ss "bitbucket.org/qiuyuzhou/shadowsocks/core"
+)
+
+func TestSocksReply(t *testing.T) {
+    a.Equal(t, []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}, socksReply(socksRepSucceeded, nil))
+    a.Equal(t, []byte{5, 0, 0, 1, 10, 0, 0, 1, 0x1f, 0x90},
+        socksReply(socksRepSucceeded, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8080}))
+    reply := socksReply(socksRepSucceeded, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 80})
+    a.Equal(t, 4+net.IPv6len+2, len(reply))
+    a.Equal(t, byte(4), reply[3])
+}
+
+func TestSocksReplyCode(t *testing.T) {
+    refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+    a.Equal(t, byte(socksRepConnectionRefused), socksReplyCode(refused))
+    a.Equal(t, byte(socksRepHostUnreachable), socksReplyCode(&net.DNSError{Err: "no such host", Name: "example"}))
+    a.Equal(t, byte(socksRepCmdNotSupported), socksReplyCode(errCmd))
+    a.Equal(t, byte(socksRepNotAllowed), socksReplyCode(ss.ErrConnectDenied))
+    a.Equal(t, byte(socksRepHostUnreachable), socksReplyCode(ss.ErrDNSFailure))
+    a.Equal(t, byte(socksRepGeneralFailure), socksReplyCode(errors.New("unknown")))
+}
@@ -0,0 +1,244 @@
+package main
+import (
+    "io"
+    "os"
+    "fmt"
+    "time"
+    "bufio"
+    "bytes"
+    "errors"
+    "strings"
+    "net/url"
+    "net/http"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+    "encoding/base64"
+    log "github.com/Sirupsen/logrus"
+)
+
+const defaultSubscriptionInterval = 3600
+
+// maxSubscriptionSize limits the list fetched, which is far larger than any
+// list of servers.
+const maxSubscriptionSize = 4 << 20
+
+// SubscriptionConfig is a URL of a list of servers, which are merged into the
+// servers of the config. The list has an ssp:// URL or a JSON server on each
+// line, or is a JSON array of servers, optionally encoded in base64.
+type SubscriptionConfig struct {
+    URL         string      `json:"url"`
+    // Refresh interval in seconds, 3600 by default.
+    Interval    uint        `json:"interval"`
+    // Optional, the list is saved to the file and loaded from it when the
+    // URL can't be fetched.
+    CacheFile   string      `json:"cache_file"`
+    // Optional, the group of the servers without one.
+    Group       string      `json:"group"`
+}
+
+// Subscription keeps the servers of a subscription up to date in the config.
+type Subscription struct {
+    config *SubscriptionConfig
+    target *Config
+    client *http.Client
+}
+
+func NewSubscription(sc *SubscriptionConfig, target *Config) (*Subscription, error) {
+    u, err := url.Parse(sc.URL)
+    if err != nil {
+        return nil, err
+    }
+    if u.Scheme != "http" && u.Scheme != "https" {
+        return nil, fmt.Errorf("Invalid subscription url %q, should be http or https", sc.URL)
+    }
+    self := &Subscription{
+        config: sc,
+        target: target,
+        client: &http.Client{Timeout: 30 * time.Second},
+    }
+    return self, nil
+}
+
+func (self *Subscription) interval() time.Duration {
+    if self.config.Interval == 0 {
+        return defaultSubscriptionInterval * time.Second
+    }
+    return time.Duration(self.config.Interval) * time.Second
+}
+
+func (self *Subscription) fetch() ([]byte, error) {
+    req, err := http.NewRequest("GET", self.config.URL, nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("User-Agent", "ssplocal")
+    resp, err := self.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("Fetch subscription failed: %v", resp.Status)
+    }
+    data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSubscriptionSize + 1))
+    if err != nil {
+        return nil, err
+    }
+    if len(data) > maxSubscriptionSize {
+        return nil, fmt.Errorf("Subscription is larger than %v bytes", maxSubscriptionSize)
+    }
+    return data, nil
+}
+
+// saveCache replaces the cache file with the data, through a temporary file
+// so that it is never left half written.
+func (self *Subscription) saveCache(data []byte) error {
+    path := self.config.CacheFile
+    tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path) + ".")
+    if err != nil {
+        return err
+    }
+    if _, err = tmp.Write(data); err == nil {
+        err = tmp.Close()
+    } else {
+        tmp.Close()
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), path)
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+    }
+    return err
+}
+
+// Update fetches the list and merges its servers into the config. The cache
+// file is used if fetching fails, unless fromCache is false. The servers in
+// the config are kept if it returns an error.
+func (self *Subscription) Update(fromCache bool) error {
+    data, err := self.fetch()
+    if err == nil {
+        var servers []*ServerEndpointConfig
+        if servers, err = parseSubscription(data); err == nil {
+            self.merge(servers)
+            if self.config.CacheFile != "" {
+                if err := self.saveCache(data); err != nil {
+                    log.WithField("file", self.config.CacheFile).Warning("Save subscription cache failed: ", err)
+                }
+            }
+            return nil
+        }
+    }
+    if !fromCache || self.config.CacheFile == "" {
+        return err
+    }
+    log.WithFields(log.Fields{"url": self.config.URL, "error": err}).Warning("Update subscription failed, loading the cache.")
+    data, err = ioutil.ReadFile(self.config.CacheFile)
+    if err != nil {
+        return err
+    }
+    servers, err := parseSubscription(data)
+    if err != nil {
+        return err
+    }
+    self.merge(servers)
+    return nil
+}
+
+func (self *Subscription) merge(servers []*ServerEndpointConfig) {
+    if self.config.Group != "" {
+        for _, ep := range servers {
+            if ep.Group == "" {
+                ep.Group = self.config.Group
+            }
+        }
+    }
+    self.target.setSubscribed(self.config, servers)
+    log.WithFields(log.Fields{"url": self.config.URL, "servers": len(servers)}).Info("Updated servers of subscription.")
+}
+
+// Run updates the subscription periodically, it never returns.
+func (self *Subscription) Run() {
+    for {
+        time.Sleep(self.interval())
+        if err := self.Update(false); err != nil {
+            log.WithFields(log.Fields{"url": self.config.URL, "error": err}).Warning("Update subscription failed.")
+        }
+    }
+}
+
+// decodeBase64 decodes s in the standard or URL encoding, with or without
+// padding.
+func decodeBase64(s string) ([]byte, error) {
+    var err error
+    for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+        var data []byte
+        if data, err = enc.DecodeString(s); err == nil {
+            return data, nil
+        }
+    }
+    return nil, err
+}
+
+// parseSubscription parses the servers of a subscription, skipping the
+// invalid ones. It fails if there is no valid server.
+func parseSubscription(data []byte) ([]*ServerEndpointConfig, error) {
+    data = bytes.TrimSpace(data)
+    if !bytes.HasPrefix(data, []byte("ssp://")) && !bytes.HasPrefix(data, []byte("{")) && !bytes.HasPrefix(data, []byte("[")) {
+        decoded, err := decodeBase64(string(bytes.Join(bytes.Fields(data), nil)))
+        if err != nil {
+            return nil, fmt.Errorf("Invalid subscription: %v", err)
+        }
+        data = bytes.TrimSpace(decoded)
+    }
+
+    var entries []*ServerEndpointConfig
+    if bytes.HasPrefix(data, []byte("[")) {
+        if err := json.Unmarshal(data, &entries); err != nil {
+            return nil, fmt.Errorf("Invalid subscription: %v", err)
+        }
+    } else {
+        scanner := bufio.NewScanner(bytes.NewReader(data))
+        for scanner.Scan() {
+            line := strings.TrimSpace(scanner.Text())
+            if line == "" || strings.HasPrefix(line, "#") {
+                continue
+            }
+            if strings.HasPrefix(line, "{") {
+                ep := &ServerEndpointConfig{}
+                if err := json.Unmarshal([]byte(line), ep); err != nil {
+                    log.WithField("error", err).Warning("Skip invalid server of subscription.")
+                    continue
+                }
+                entries = append(entries, ep)
+                continue
+            }
+            ep, err := parseSSPUrl(line)
+            if err != nil {
+                log.WithField("error", err).Warning("Skip invalid server of subscription.")
+                continue
+            }
+            entries = append(entries, ep)
+        }
+        if err := scanner.Err(); err != nil {
+            return nil, err
+        }
+    }
+
+    servers := make([]*ServerEndpointConfig, 0, len(entries))
+    for _, ep := range entries {
+        if ep == nil {
+            continue
+        }
+        if valid, err := ep.Validate(); !valid || err != nil {
+            log.WithFields(log.Fields{"address": ep.Address, "error": err}).Warning("Skip invalid server of subscription.")
+            continue
+        }
+        servers = append(servers, ep)
+    }
+    if len(servers) == 0 {
+        return nil, errors.New("Not found valid server in subscription")
+    }
+    return servers, nil
+}
@@ -0,0 +1,25 @@
+package main
+import (
+    "net"
+    log "github.com/Sirupsen/logrus"
+    ss "bitbucket.org/qiuyuzhou/shadowsocks/core"
+)
+
+// handleTunnelConnection forwards the connection to the target of the tunnel
+// listener through its server.
+func handleTunnelConnection(l *Listener, conn net.Conn) {
+    target := l.config.Target
+    ep := l.Server(nil)
+    var remote net.Conn
+    err := errNoServer
+    if ep != nil {
+        remote, err = ss.DialTimeout(target, ep.Address, ep, config.GetConnectTimeout())
+    }
+    if err != nil {
+        log.WithFields(log.Fields{"listen": l.config.Address, "target": target}).Debug("error when create connection to server: ", err)
+        conn.Close()
+        return
+    }
+    log.WithField("addr", target).Infof("Proxy tunnel connection to %v", target)
+    relayConn(conn, remote)
+}
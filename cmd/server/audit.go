@@ -0,0 +1,131 @@
+package main
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "encoding/json"
+    ss "bitbucket.org/qiuyuzhou/shadowsocks/core"
+    log "github.com/Sirupsen/logrus"
+)
+
+type AuditLogConfig struct {
+    Path string         `json:"path"`
+    MaxSizeMB int64     `json:"max_size_mb"`
+    MaxBackups int      `json:"max_backups"`
+}
+
+// AuditRecord describes one finished relay. Up is the client to remote
+// direction.
+type AuditRecord struct {
+    Token string        `json:"token"`
+    Src string          `json:"src"`
+    Dst string          `json:"dst"`
+    BytesUp int64       `json:"bytes_up"`
+    BytesDown int64     `json:"bytes_down"`
+    Start time.Time     `json:"start"`
+    End time.Time       `json:"end"`
+    CloseReason string  `json:"close_reason"`
+}
+
+// AuditLogger appends audit records as JSON lines to a file, which is rotated
+// to path.1, path.2 ... when it grows over the size limit.
+type AuditLogger struct {
+    config AuditLogConfig
+
+    mutex sync.Mutex
+    file *os.File
+    size int64
+}
+
+func NewAuditLogger(config *AuditLogConfig) (*AuditLogger, error) {
+    self := &AuditLogger{config: *config}
+    if self.config.Path == "" {
+        return nil, fmt.Errorf("Must specify path for audit log")
+    }
+    if self.config.MaxSizeMB <= 0 {
+        self.config.MaxSizeMB = 100
+    }
+    if self.config.MaxBackups < 0 {
+        self.config.MaxBackups = 0
+    }
+    if err := self.open(); err != nil {
+        return nil, err
+    }
+    return self, nil
+}
+
+func (self *AuditLogger) open() error {
+    file, err := os.OpenFile(self.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+    if err != nil {
+        return err
+    }
+    stat, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return err
+    }
+    self.file = file
+    self.size = stat.Size()
+    return nil
+}
+
+func (self *AuditLogger) rotate() error {
+    if err := self.file.Close(); err != nil {
+        return err
+    }
+    if self.config.MaxBackups == 0 {
+        if err := os.Remove(self.config.Path); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        return self.open()
+    }
+    for i := self.config.MaxBackups - 1; i > 0; i-- {
+        from := fmt.Sprintf("%s.%d", self.config.Path, i)
+        to := fmt.Sprintf("%s.%d", self.config.Path, i+1)
+        if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+    if err := os.Rename(self.config.Path, self.config.Path+".1"); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return self.open()
+}
+
+func (self *AuditLogger) Log(record *AuditRecord) {
+    data, err := json.Marshal(record)
+    if err != nil {
+        log.WithField("error", err).Error("Marshal audit record failed.")
+        return
+    }
+    data = append(data, '\n')
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+    if self.size > 0 && self.size+int64(len(data)) > self.config.MaxSizeMB*1024*1024 {
+        if err := self.rotate(); err != nil {
+            log.WithField("error", err).Error("Rotate audit log failed.")
+            return
+        }
+    }
+    n, err := self.file.Write(data)
+    self.size += int64(n)
+    if err != nil {
+        log.WithField("error", err).Error("Write audit log failed.")
+    }
+}
+
+// closeReason describes which side finished the relay first and why.
+func closeReason(up, down *ss.PipeResult) string {
+    if up.End.Before(down.End) {
+        if up.Err != nil {
+            return "client error: " + up.Err.Error()
+        }
+        return "client closed"
+    }
+    if down.Err != nil {
+        return "remote error: " + down.Err.Error()
+    }
+    return "remote closed"
+}
@@ -0,0 +1,204 @@
+package main
+import (
+    "net"
+    "sync"
+    "time"
+    "fmt"
+    log "github.com/Sirupsen/logrus"
+)
+
+type BanConfig struct {
+    MaxFailures int                     `json:"max_failures"`
+    FindTimeSeconds time.Duration       `json:"find_time_seconds"`
+    BanTimeSeconds time.Duration        `json:"ban_time_seconds"`
+    // Bans are applied to the whole network of the offending address,
+    // 32 and 128 mean a single address.
+    IPv4PrefixLen int                   `json:"ipv4_prefix_len"`
+    IPv6PrefixLen int                   `json:"ipv6_prefix_len"`
+    Allowlist []string                  `json:"allowlist"`
+}
+
+// Banner bans source networks which fail too many handshakes within the find
+// time window, in the manner of fail2ban.
+type Banner struct {
+    config BanConfig
+    allowlist []*net.IPNet
+
+    mutex sync.Mutex
+    failures map[string][]time.Time
+    bans map[string]time.Time
+}
+
+func NewBanner(config *BanConfig) (*Banner, error) {
+    self := &Banner{
+        config: *config,
+        failures: make(map[string][]time.Time),
+        bans: make(map[string]time.Time),
+    }
+    if self.config.MaxFailures <= 0 {
+        self.config.MaxFailures = 5
+    }
+    if self.config.FindTimeSeconds <= 0 {
+        self.config.FindTimeSeconds = 600
+    }
+    if self.config.BanTimeSeconds <= 0 {
+        self.config.BanTimeSeconds = 3600
+    }
+    if self.config.IPv4PrefixLen <= 0 || self.config.IPv4PrefixLen > 32 {
+        self.config.IPv4PrefixLen = 32
+    }
+    if self.config.IPv6PrefixLen <= 0 || self.config.IPv6PrefixLen > 128 {
+        self.config.IPv6PrefixLen = 128
+    }
+
+    for _, s := range self.config.Allowlist {
+        ipNet, err := parseIPOrCIDR(s)
+        if err != nil {
+            return nil, err
+        }
+        self.allowlist = append(self.allowlist, ipNet)
+    }
+
+    go self.svc()
+    return self, nil
+}
+
+func parseIPOrCIDR(s string) (*net.IPNet, error) {
+    if _, ipNet, err := net.ParseCIDR(s); err == nil {
+        return ipNet, nil
+    }
+    ip := net.ParseIP(s)
+    if ip == nil {
+        return nil, fmt.Errorf("Invalid IP or CIDR: %v", s)
+    }
+    if ip4 := ip.To4(); ip4 != nil {
+        return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+    }
+    return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+    switch a := addr.(type) {
+        case *net.TCPAddr:
+            return a.IP
+        case *net.UDPAddr:
+            return a.IP
+    }
+    host, _, err := net.SplitHostPort(addr.String())
+    if err != nil {
+        return nil
+    }
+    return net.ParseIP(host)
+}
+
+// banKey returns the network which the address is banned as, or "" if the
+// address can't be banned.
+func (self *Banner) banKey(addr net.Addr) string {
+    ip := addrIP(addr)
+    if ip == nil {
+        return ""
+    }
+    for _, ipNet := range self.allowlist {
+        if ipNet.Contains(ip) {
+            return ""
+        }
+    }
+    if ip4 := ip.To4(); ip4 != nil {
+        ipNet := net.IPNet{IP: ip4.Mask(net.CIDRMask(self.config.IPv4PrefixLen, 32)), Mask: net.CIDRMask(self.config.IPv4PrefixLen, 32)}
+        return ipNet.String()
+    }
+    ipNet := net.IPNet{IP: ip.Mask(net.CIDRMask(self.config.IPv6PrefixLen, 128)), Mask: net.CIDRMask(self.config.IPv6PrefixLen, 128)}
+    return ipNet.String()
+}
+
+func (self *Banner) IsBanned(addr net.Addr) bool {
+    key := self.banKey(addr)
+    if key == "" {
+        return false
+    }
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+    expire, ok := self.bans[key]
+    return ok && time.Now().Before(expire)
+}
+
+// RecordFailure counts a failed attempt from the address, and bans its network
+// when the failures within the find time reach the limit.
+func (self *Banner) RecordFailure(addr net.Addr) {
+    key := self.banKey(addr)
+    if key == "" {
+        return
+    }
+    now := time.Now()
+    since := now.Add(-self.config.FindTimeSeconds * time.Second)
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+    if expire, ok := self.bans[key]; ok && now.Before(expire) {
+        return
+    }
+    failures := recentFailures(self.failures[key], since)
+    failures = append(failures, now)
+    if len(failures) < self.config.MaxFailures {
+        self.failures[key] = failures
+        return
+    }
+
+    delete(self.failures, key)
+    expire := now.Add(self.config.BanTimeSeconds * time.Second)
+    self.bans[key] = expire
+    log.WithFields(log.Fields{
+        "network": key,
+        "failures": len(failures),
+        "expire": expire.Format(time.RFC3339),
+    }).Warnf("Ban %v", key)
+}
+
+func recentFailures(failures []time.Time, since time.Time) []time.Time {
+    i := 0
+    for i < len(failures) && failures[i].Before(since) {
+        i++
+    }
+    return failures[i:]
+}
+
+// LogBans writes the current ban list to the log.
+func (self *Banner) LogBans() {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+    log.WithField("count", len(self.bans)).Info("Ban list")
+    for key, expire := range self.bans {
+        log.WithFields(log.Fields{
+            "network": key,
+            "expire": expire.Format(time.RFC3339),
+        }).Info("Banned")
+    }
+}
+
+func (self *Banner) svc() {
+    for range time.Tick(time.Minute) {
+        self.cleanup()
+    }
+}
+
+func (self *Banner) cleanup() {
+    now := time.Now()
+    since := now.Add(-self.config.FindTimeSeconds * time.Second)
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+    for key, expire := range self.bans {
+        if !now.Before(expire) {
+            delete(self.bans, key)
+            log.WithField("network", key).Infof("Unban %v", key)
+        }
+    }
+    for key, failures := range self.failures {
+        failures = recentFailures(failures, since)
+        if len(failures) == 0 {
+            delete(self.failures, key)
+        } else {
+            self.failures[key] = failures
+        }
+    }
+}
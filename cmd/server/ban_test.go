@@ -0,0 +1,32 @@
+package main
+import (
+    "testing"
+    "net"
+    a "github.com/stretchr/testify/assert"
+)
+
+func TestBanner(t *testing.T) {
+    b, err := NewBanner(&BanConfig{
+        MaxFailures: 3,
+        IPv4PrefixLen: 24,
+        Allowlist: []string{"10.0.0.0/8", "192.168.1.1"},
+    })
+    a.Nil(t, err)
+
+    src := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1000}
+    neighbour := &net.TCPAddr{IP: net.ParseIP("1.2.3.5"), Port: 2000}
+    for i := 0; i < 2; i++ {
+        b.RecordFailure(src)
+    }
+    a.False(t, b.IsBanned(src))
+    b.RecordFailure(neighbour)
+    a.True(t, b.IsBanned(src))
+    a.True(t, b.IsBanned(neighbour))
+    a.False(t, b.IsBanned(&net.TCPAddr{IP: net.ParseIP("1.2.4.4"), Port: 1000}))
+
+    allowed := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1000}
+    for i := 0; i < 5; i++ {
+        b.RecordFailure(allowed)
+    }
+    a.False(t, b.IsBanned(allowed))
+}
@@ -5,17 +5,44 @@ import (
     "encoding/json"
     ss "bitbucket.org/qiuyuzhou/shadowsocks/core"
     "errors"
+    "time"
     log "github.com/Sirupsen/logrus"
 )
 
+type ListenerConfig struct {
+    Address string      `json:"address"`
+    // Read a PROXY protocol v1/v2 header before the ssp handshake.
+    ProxyProtocol bool  `json:"proxy_protocol"`
+}
+
 type Config struct {
     Listen []string     `json:"listen"`
+    Listeners []*ListenerConfig `json:"listeners"`
     Method string       `json:"method"`
     Password string     `json:"password"`
+    // Idle timeout of relays in seconds, 0 to disable.
     Timeout uint        `json:"timeout"`
+    // Timeout of the PROXY protocol header, the ssp handshake and the request.
+    HandshakeTimeoutSeconds time.Duration   `json:"handshake_timeout_seconds"`
+    // How long a relay lingers after one direction is half-closed.
+    LingerTimeoutSeconds time.Duration  `json:"linger_timeout_seconds"`
 
     TokensPlugins map[string]json.RawMessage `json:"tokens_plugins"`
 
+    Outbounds map[string]*OutboundConfig `json:"outbounds"`
+    OutboundRules []*OutboundRule   `json:"outbound_rules"`
+    Resolver *ResolverConfig    `json:"resolver"`
+    // Source address options of outbound connections, globally and per token.
+    Dial *DialConfig    `json:"dial"`
+    TokenDial map[string]*DialConfig `json:"token_dial"`
+    DialTimeoutSeconds time.Duration    `json:"dial_timeout_seconds"`
+    // Race the addresses of the destination as RFC 8305 Happy Eyeballs.
+    HappyEyeballs bool  `json:"happy_eyeballs"`
+    HappyEyeballsDelayMs time.Duration  `json:"happy_eyeballs_delay_ms"`
+
+    Ban *BanConfig      `json:"ban"`
+    AuditLog *AuditLogConfig    `json:"audit_log"`
+
     headerCipher *ss.Cipher
 }
 
@@ -39,6 +66,30 @@ func ParseConfig(path string) (config *Config, err error) {
     return
 }
 
+// GetListeners returns the plain listen addresses together with the
+// listeners configured in detail.
+func (c *Config)GetListeners() []*ListenerConfig {
+    listeners := make([]*ListenerConfig, 0, len(c.Listen)+len(c.Listeners))
+    for _, addr := range c.Listen {
+        listeners = append(listeners, &ListenerConfig{Address: addr})
+    }
+    return append(listeners, c.Listeners...)
+}
+
+func (c *Config)GetHandshakeTimeout() time.Duration {
+    if c.HandshakeTimeoutSeconds <= 0 {
+        return 30 * time.Second
+    }
+    return c.HandshakeTimeoutSeconds * time.Second
+}
+
+func (c *Config)GetLingerTimeout() time.Duration {
+    if c.LingerTimeoutSeconds <= 0 {
+        return 30 * time.Second
+    }
+    return c.LingerTimeoutSeconds * time.Second
+}
+
 func (c *Config)GetServerSecret() string {
     return c.Password
 }
@@ -55,10 +106,16 @@ func (c *Config)Validate() (bool, error) {
     var err error
     valid := true
 
-    if len(c.Listen) == 0 {
+    if len(c.Listen) == 0 && len(c.Listeners) == 0 {
         log.Error("Must specify address for server")
         valid = false
     }
+    for _, l := range c.Listeners {
+        if l.Address == "" {
+            log.Error("Must specify address for listener")
+            valid = false
+        }
+    }
     if c.Password == "" {
         log.Error("Must specify password for server")
         valid = false
@@ -0,0 +1,305 @@
+package main
+import (
+    "net"
+    "fmt"
+    "time"
+    "context"
+    "hash/fnv"
+    "math/rand"
+    "sync/atomic"
+    log "github.com/Sirupsen/logrus"
+)
+
+type DialConfig struct {
+    // Local addresses to bind outbound connections to, one is chosen per
+    // connection with the strategy.
+    BindAddresses []string  `json:"bind_addresses"`
+    // One of round_robin, random and hash. hash keeps the same local address
+    // for the same destination host.
+    Strategy string         `json:"strategy"`
+    // SO_MARK of outbound sockets, linux only.
+    Mark int                `json:"mark"`
+    // Interface to bind outbound sockets to, linux only.
+    Interface string        `json:"interface"`
+}
+
+// Dialer makes the outbound TCP connections of the server with the source
+// address options.
+type Dialer struct {
+    config DialConfig
+    resolver *Resolver
+    bindIPs []net.IP
+    next uint32
+
+    timeout time.Duration
+    // Delay between the connection attempts of Happy Eyeballs, 0 if the
+    // addresses are dialed one by one.
+    fallbackDelay time.Duration
+}
+
+func NewDialer(config *DialConfig, serverConfig *Config, resolver *Resolver) (*Dialer, error) {
+    self := &Dialer{
+        resolver: resolver,
+        timeout: serverConfig.DialTimeoutSeconds * time.Second,
+    }
+    if self.timeout <= 0 {
+        self.timeout = 10 * time.Second
+    }
+    if serverConfig.HappyEyeballs {
+        self.fallbackDelay = serverConfig.HappyEyeballsDelayMs * time.Millisecond
+        if self.fallbackDelay <= 0 {
+            // The recommended connection attempt delay of RFC 8305.
+            self.fallbackDelay = 250 * time.Millisecond
+        }
+    }
+    if config != nil {
+        self.config = *config
+    }
+    switch self.config.Strategy {
+        case "":
+            self.config.Strategy = "round_robin"
+        case "round_robin", "random", "hash":
+        default:
+            return nil, fmt.Errorf("Unknown dial strategy %v", self.config.Strategy)
+    }
+    for _, s := range self.config.BindAddresses {
+        ip := net.ParseIP(s)
+        if ip == nil {
+            return nil, fmt.Errorf("Invalid bind address %v", s)
+        }
+        self.bindIPs = append(self.bindIPs, ip)
+    }
+    if self.config.Mark != 0 || self.config.Interface != "" {
+        if err := checkSocketOptions(); err != nil {
+            return nil, err
+        }
+    }
+    return self, nil
+}
+
+// selectBindIP chooses the bind address by the strategy among those of the
+// address families of the destination ips, nil if none is configured.
+func (self *Dialer) selectBindIP(host string, ips []net.IP) (net.IP, error) {
+    if len(self.bindIPs) == 0 {
+        return nil, nil
+    }
+    hasIPv4, hasIPv6 := false, false
+    for _, ip := range ips {
+        if ip.To4() != nil {
+            hasIPv4 = true
+        } else {
+            hasIPv6 = true
+        }
+    }
+    pool := make([]net.IP, 0, len(self.bindIPs))
+    for _, ip := range self.bindIPs {
+        if ip.To4() != nil && hasIPv4 || ip.To4() == nil && hasIPv6 {
+            pool = append(pool, ip)
+        }
+    }
+    switch len(pool) {
+        case 0:
+            return nil, fmt.Errorf("no bind address matches the address family of %v", host)
+        case 1:
+            return pool[0], nil
+    }
+    var i int
+    switch self.config.Strategy {
+        case "random":
+            i = rand.Intn(len(pool))
+        case "hash":
+            h := fnv.New32a()
+            h.Write([]byte(host))
+            i = int(h.Sum32() % uint32(len(pool)))
+        default:
+            i = int((atomic.AddUint32(&self.next, 1) - 1) % uint32(len(pool)))
+    }
+    return pool[i], nil
+}
+
+// Dial connects to the upstream servers in the server config.
+func (self *Dialer) Dial(network, addr string) (net.Conn, error) {
+    return self.dial(network, addr, false)
+}
+
+// DialDestination connects to the destinations requested by clients, which are
+// checked by the destination ACL of the resolver.
+func (self *Dialer) DialDestination(network, addr string) (net.Conn, error) {
+    return self.dial(network, addr, true)
+}
+
+func (self *Dialer) dial(network, addr string, isDestination bool) (net.Conn, error) {
+    host, port, err := net.SplitHostPort(addr)
+    if err != nil {
+        return nil, err
+    }
+    var ips []net.IP
+    if isDestination {
+        ips, err = self.resolver.LookupDestinationIP(host)
+    } else {
+        ips, err = self.resolver.LookupIP(host)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    bindIP, err := self.selectBindIP(host, ips)
+    if err != nil {
+        return nil, err
+    }
+    d := &net.Dialer{Timeout: self.timeout}
+    if ip := bindIP; ip != nil {
+        d.LocalAddr = &net.TCPAddr{IP: ip}
+        // Only the addresses of the same family as the bind address can be
+        // dialed.
+        isIPv4 := ip.To4() != nil
+        matched := make([]net.IP, 0, len(ips))
+        for _, ip := range ips {
+            if (ip.To4() != nil) == isIPv4 {
+                matched = append(matched, ip)
+            }
+        }
+        ips = matched
+    }
+    if self.config.Mark != 0 || self.config.Interface != "" {
+        d.Control = self.control
+    }
+
+    if self.fallbackDelay > 0 && len(ips) > 1 {
+        return self.dialParallel(d, network, host, port, ips)
+    }
+
+    var failures []*dialFailure
+    for _, ip := range ips {
+        var conn net.Conn
+        if conn, err = d.Dial(network, net.JoinHostPort(ip.String(), port)); err == nil {
+            logDialFailures(host, failures)
+            return conn, nil
+        }
+        failures = append(failures, &dialFailure{ip, err})
+    }
+    logDialFailures(host, failures)
+    return nil, err
+}
+
+type dialFailure struct {
+    ip net.IP
+    err error
+}
+
+func ipFamily(ip net.IP) string {
+    if ip.To4() != nil {
+        return "ipv4"
+    }
+    return "ipv6"
+}
+
+// logDialFailures reports the failed attempts of a dial by address family.
+func logDialFailures(host string, failures []*dialFailure) {
+    counts := make(map[string]int)
+    for _, f := range failures {
+        family := ipFamily(f.ip)
+        counts[family]++
+        log.WithFields(log.Fields{
+            "host": host,
+            "ip": f.ip,
+            "family": family,
+            "error": f.err,
+        }).Debug("Dial attempt failed")
+    }
+    for family, count := range counts {
+        log.WithFields(log.Fields{
+            "host": host,
+            "family": family,
+            "failures": count,
+        }).Infof("Dial %v over %v failed", host, family)
+    }
+}
+
+// interleaveIPs alternates the address families, starting with the family of
+// the first address, as RFC 8305 section 4.
+func interleaveIPs(ips []net.IP) []net.IP {
+    var first, second []net.IP
+    firstIsIPv4 := ips[0].To4() != nil
+    for _, ip := range ips {
+        if (ip.To4() != nil) == firstIsIPv4 {
+            first = append(first, ip)
+        } else {
+            second = append(second, ip)
+        }
+    }
+    result := make([]net.IP, 0, len(ips))
+    for i := 0; i < len(first) || i < len(second); i++ {
+        if i < len(first) {
+            result = append(result, first[i])
+        }
+        if i < len(second) {
+            result = append(result, second[i])
+        }
+    }
+    return result
+}
+
+// dialParallel races the connection attempts in the manner of Happy Eyeballs,
+// an attempt is started after each fallback delay or failure of the previous
+// one, and the first established connection wins.
+func (self *Dialer) dialParallel(d *net.Dialer, network, host, port string, ips []net.IP) (net.Conn, error) {
+    type dialResult struct {
+        conn net.Conn
+        ip net.IP
+        err error
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), self.timeout)
+    defer cancel()
+
+    ips = interleaveIPs(ips)
+    results := make(chan *dialResult, len(ips))
+    started, pending := 0, 0
+    start := func() {
+        ip := ips[started]
+        started++
+        pending++
+        go func() {
+            conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+            results <- &dialResult{conn, ip, err}
+        }()
+    }
+
+    var failures []*dialFailure
+    var lastErr error
+    timer := time.NewTimer(self.fallbackDelay)
+    defer timer.Stop()
+    start()
+    for pending > 0 {
+        select {
+            case <-timer.C:
+                if started < len(ips) {
+                    start()
+                    timer.Reset(self.fallbackDelay)
+                }
+            case r := <-results:
+                pending--
+                if r.err == nil {
+                    // Close the connections of the attempts which lose the race.
+                    go func(n int) {
+                        for i := 0; i < n; i++ {
+                            if r := <-results; r.conn != nil {
+                                r.conn.Close()
+                            }
+                        }
+                    }(pending)
+                    logDialFailures(host, failures)
+                    return r.conn, nil
+                }
+                failures = append(failures, &dialFailure{r.ip, r.err})
+                lastErr = r.err
+                if started < len(ips) {
+                    start()
+                    timer.Reset(self.fallbackDelay)
+                }
+        }
+    }
+    logDialFailures(host, failures)
+    return nil, lastErr
+}
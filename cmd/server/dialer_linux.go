@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package main
+import (
+    "syscall"
+)
+
+func checkSocketOptions() error {
+    return nil
+}
+
+func (self *Dialer) control(network, address string, c syscall.RawConn) error {
+    var err error
+    cerr := c.Control(func(fd uintptr) {
+        if self.config.Mark != 0 {
+            if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, self.config.Mark); err != nil {
+                return
+            }
+        }
+        if self.config.Interface != "" {
+            err = syscall.BindToDevice(int(fd), self.config.Interface)
+        }
+    })
+    if cerr != nil {
+        return cerr
+    }
+    return err
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+import (
+    "errors"
+    "syscall"
+)
+
+func checkSocketOptions() error {
+    return errors.New("mark and interface of dial are only supported on linux")
+}
+
+func (self *Dialer) control(network, address string, c syscall.RawConn) error {
+    return nil
+}
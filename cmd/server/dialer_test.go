@@ -0,0 +1,136 @@
+package main
+import (
+    "net"
+    "time"
+    "context"
+    "testing"
+    "syscall"
+    a "github.com/stretchr/testify/assert"
+)
+
+func parseIPs(addrs ...string) []net.IP {
+    ips := make([]net.IP, len(addrs))
+    for i, addr := range addrs {
+        ips[i] = net.ParseIP(addr)
+    }
+    return ips
+}
+
+func TestSelectBindIP(t *testing.T) {
+    mixed := []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2"}
+    cases := []struct {
+        name string
+        bind []string
+        strategy string
+        ips []net.IP
+        // The bind addresses chosen by the consecutive dials, empty if the
+        // dial fails.
+        expected []string
+    }{
+        {"no bind address", nil, "", parseIPs("203.0.113.1"), []string{""}},
+        {"single", []string{"192.0.2.1"}, "", parseIPs("203.0.113.1"), []string{"192.0.2.1", "192.0.2.1"}},
+        {"single of other family", []string{"192.0.2.1"}, "", parseIPs("2001:db8::10"), nil},
+        {"round robin ipv4", mixed, "round_robin", parseIPs("203.0.113.1"), []string{"192.0.2.1", "192.0.2.2", "192.0.2.1"}},
+        {"round robin ipv6", mixed, "round_robin", parseIPs("2001:db8::10"), []string{"2001:db8::1", "2001:db8::2", "2001:db8::1"}},
+        {"round robin dual stack", mixed, "round_robin", parseIPs("2001:db8::10", "203.0.113.1"), []string{"192.0.2.1", "2001:db8::1", "192.0.2.2"}},
+        {"random ipv6", mixed, "random", parseIPs("2001:db8::10"), []string{"2001:db8::", "2001:db8::", "2001:db8::"}},
+        {"hash ipv4", mixed, "hash", parseIPs("203.0.113.1"), []string{"192.0.2.", "192.0.2."}},
+        {"ipv6 only pool", []string{"2001:db8::1", "2001:db8::2"}, "hash", parseIPs("203.0.113.1"), nil},
+    }
+    for _, c := range cases {
+        d, err := NewDialer(&DialConfig{BindAddresses: c.bind, Strategy: c.strategy}, &Config{}, nil)
+        if err != nil {
+            t.Fatal(c.name, err)
+        }
+        if c.expected == nil {
+            _, err := d.selectBindIP("example.com", c.ips)
+            a.NotNil(t, err, c.name)
+            continue
+        }
+        for _, expected := range c.expected {
+            ip, err := d.selectBindIP("example.com", c.ips)
+            a.Nil(t, err, c.name)
+            if expected == "" {
+                a.Nil(t, ip, c.name)
+            } else {
+                a.Contains(t, ip.String(), expected, c.name)
+            }
+        }
+    }
+
+    // hash keeps the bind address of a host.
+    d, _ := NewDialer(&DialConfig{BindAddresses: mixed, Strategy: "hash"}, &Config{}, nil)
+    first, _ := d.selectBindIP("example.com", parseIPs("2001:db8::10"))
+    for i := 0; i < 5; i++ {
+        ip, _ := d.selectBindIP("example.com", parseIPs("2001:db8::10"))
+        a.Equal(t, first, ip)
+    }
+}
+
+func TestInterleaveIPs(t *testing.T) {
+    cases := []struct {
+        ips []string
+        expected []string
+    }{
+        {[]string{"192.0.2.1"}, []string{"192.0.2.1"}},
+        {[]string{"192.0.2.1", "192.0.2.2"}, []string{"192.0.2.1", "192.0.2.2"}},
+        {[]string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"}, []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"}},
+        {[]string{"192.0.2.1", "2001:db8::1", "2001:db8::2", "2001:db8::3"}, []string{"192.0.2.1", "2001:db8::1", "2001:db8::2", "2001:db8::3"}},
+        {[]string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1"}, []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "192.0.2.3"}},
+    }
+    for _, c := range cases {
+        a.Equal(t, parseIPs(c.expected...), interleaveIPs(parseIPs(c.ips...)), "%v", c.ips)
+    }
+}
+
+// TestDialParallel stalls the attempts over IPv6, so the IPv4 attempt started
+// after the fallback delay wins.
+func TestDialParallel(t *testing.T) {
+    ln, err := net.Listen("tcp4", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            conn.Close()
+        }
+    }()
+    _, port, _ := net.SplitHostPort(ln.Addr().String())
+
+    stalled := make(chan struct{}, 1)
+    d := &net.Dialer{
+        ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+            if network == "tcp6" {
+                stalled <- struct{}{}
+                <-ctx.Done()
+                return ctx.Err()
+            }
+            return nil
+        },
+    }
+    const delay = 100 * time.Millisecond
+    dialer, err := NewDialer(nil, &Config{HappyEyeballs: true, HappyEyeballsDelayMs: 100}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    start := time.Now()
+    conn, err := dialer.dialParallel(d, "tcp", "localhost", port, parseIPs("::1", "127.0.0.1"))
+    elapsed := time.Since(start)
+    select {
+        case <-stalled:
+        default:
+            t.Skip("IPv6 unavailable")
+    }
+    if !a.Nil(t, err) {
+        return
+    }
+    defer conn.Close()
+    a.Equal(t, ln.Addr().String(), conn.RemoteAddr().String())
+    a.True(t, elapsed >= delay, "IPv4 attempt started before the fallback delay: %v", elapsed)
+    a.True(t, elapsed < dialer.timeout, "IPv4 attempt waited for the stalled one: %v", elapsed)
+}
@@ -0,0 +1,440 @@
+package main
+import (
+    "net"
+    "io"
+    "fmt"
+    "bufio"
+    "errors"
+    "strings"
+    "strconv"
+    "time"
+    "net/http"
+    "encoding/base64"
+    "encoding/binary"
+    ss "bitbucket.org/qiuyuzhou/shadowsocks/core"
+    log "github.com/Sirupsen/logrus"
+)
+
+const directOutboundName = "direct"
+
+var (
+    errNotFoundOutbound = errors.New("Not found the outbound.")
+    errSocksUpstream = errors.New("socks5 upstream handshake failed")
+)
+
+// Outbound makes the connections to the destinations requested by clients,
+// the TCP connections it makes itself go through the dialer.
+type Outbound interface {
+    Dial(dialer *Dialer, addr string) (net.Conn, error)
+}
+
+type OutboundConfig struct {
+    // One of direct, socks5, http and ssp.
+    Type string         `json:"type"`
+    Address string      `json:"address"`
+    // Username and password for socks5 and http upstreams, the password is
+    // also the server password of ssp upstreams.
+    Username string     `json:"username"`
+    Password string     `json:"password"`
+    // Only for ssp upstreams.
+    Method string       `json:"method"`
+    Token string        `json:"token"`
+    TokenSecret string  `json:"token_secret"`
+}
+
+// OutboundRule selects the outbound for the connections matching all the
+// given conditions, an empty condition matches everything.
+type OutboundRule struct {
+    Tokens []string     `json:"tokens"`
+    // Domain suffixes of the destination.
+    Domains []string    `json:"domains"`
+    // Networks of the destination, only match IP destinations.
+    CIDRs []string      `json:"cidrs"`
+    Outbound string     `json:"outbound"`
+
+    networks []*net.IPNet
+}
+
+type OutboundManager struct {
+    outbounds map[string]Outbound
+    rules []*OutboundRule
+
+    dialer *Dialer
+    tokenDialers map[string]*Dialer
+}
+
+func NewOutboundManager(config *Config, resolver *Resolver) (*OutboundManager, error) {
+    m := &OutboundManager{
+        outbounds: map[string]Outbound{directOutboundName: &DirectOutbound{}},
+        tokenDialers: make(map[string]*Dialer),
+    }
+
+    var err error
+    if m.dialer, err = NewDialer(config.Dial, config, resolver); err != nil {
+        return nil, err
+    }
+    for token, dc := range config.TokenDial {
+        if m.tokenDialers[token], err = NewDialer(dc, config, resolver); err != nil {
+            return nil, err
+        }
+    }
+
+    for name, oc := range config.Outbounds {
+        var outbound Outbound
+        switch oc.Type {
+            case "direct":
+                outbound = &DirectOutbound{}
+            case "socks5":
+                outbound = &Socks5Outbound{config: oc}
+            case "http":
+                outbound = &HttpOutbound{config: oc}
+            case "ssp":
+                o, err := NewSSPOutbound(oc)
+                if err != nil {
+                    return nil, err
+                }
+                outbound = o
+            default:
+                return nil, fmt.Errorf("Unknown type %v of outbound %v", oc.Type, name)
+        }
+        if oc.Type != "direct" && oc.Address == "" {
+            return nil, fmt.Errorf("Must specify address for outbound %v", name)
+        }
+        log.WithFields(log.Fields{
+            "outbound": name,
+            "type": oc.Type,
+        }).Info("Outbound initialed.")
+        m.outbounds[name] = outbound
+    }
+
+    // The rules are copied, so that the config is never modified.
+    for _, r := range config.OutboundRules {
+        rule := *r
+        rule.networks = nil
+        if _, ok := m.outbounds[rule.Outbound]; !ok {
+            return nil, fmt.Errorf("Unknown outbound %v in outbound rules", rule.Outbound)
+        }
+        for _, s := range rule.CIDRs {
+            ipNet, err := parseIPOrCIDR(s)
+            if err != nil {
+                return nil, err
+            }
+            rule.networks = append(rule.networks, ipNet)
+        }
+        m.rules = append(m.rules, &rule)
+    }
+
+    return m, nil
+}
+
+func (rule *OutboundRule) Match(token, host string) bool {
+    if len(rule.Tokens) > 0 {
+        found := false
+        for _, t := range rule.Tokens {
+            if t == token {
+                found = true
+                break
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+    if len(rule.Domains) > 0 {
+        found := false
+        for _, d := range rule.Domains {
+            d = strings.ToLower(strings.Trim(d, "."))
+            h := strings.ToLower(host)
+            if h == d || strings.HasSuffix(h, "."+d) {
+                found = true
+                break
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+    if len(rule.networks) > 0 {
+        ip := net.ParseIP(host)
+        if ip == nil {
+            return false
+        }
+        found := false
+        for _, ipNet := range rule.networks {
+            if ipNet.Contains(ip) {
+                found = true
+                break
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+    return true
+}
+
+// Select returns the name of the outbound for the token and destination.
+func (self *OutboundManager) Select(token, addr string) string {
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        return directOutboundName
+    }
+    for _, rule := range self.rules {
+        if rule.Match(token, host) {
+            return rule.Outbound
+        }
+    }
+    return directOutboundName
+}
+
+func (self *OutboundManager) Dial(token, addr string) (net.Conn, error) {
+    name := self.Select(token, addr)
+    outbound, ok := self.outbounds[name]
+    if !ok {
+        return nil, errNotFoundOutbound
+    }
+    if name != directOutboundName {
+        log.WithFields(log.Fields{
+            "outbound": name,
+            "addr": addr,
+        }).Debug("Dial through outbound")
+    }
+    dialer, ok := self.tokenDialers[token]
+    if !ok {
+        dialer = self.dialer
+    }
+    return outbound.Dial(dialer, addr)
+}
+
+type DirectOutbound struct {
+}
+
+func (self *DirectOutbound) Dial(dialer *Dialer, addr string) (net.Conn, error) {
+    return dialer.DialDestination("tcp", addr)
+}
+
+type Socks5Outbound struct {
+    config *OutboundConfig
+}
+
+func (self *Socks5Outbound) Dial(dialer *Dialer, addr string) (net.Conn, error) {
+    conn, err := dialer.Dial("tcp", self.config.Address)
+    if err != nil {
+        return nil, err
+    }
+    conn.SetDeadline(time.Now().Add(dialer.timeout))
+    if err = self.handShake(conn, addr); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    conn.SetDeadline(time.Time{})
+    return conn, nil
+}
+
+func (self *Socks5Outbound) handShake(conn net.Conn, addr string) error {
+    const (
+        socksVer5 = 5
+        methodNoAuth = 0
+        methodUserPass = 2
+    )
+    buf := make([]byte, 263)
+
+    if self.config.Username != "" {
+        _, err := conn.Write([]byte{socksVer5, 2, methodNoAuth, methodUserPass})
+        if err != nil {
+            return err
+        }
+    } else if _, err := conn.Write([]byte{socksVer5, 1, methodNoAuth}); err != nil {
+        return err
+    }
+    if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+        return err
+    }
+    if buf[0] != socksVer5 {
+        return errSocksUpstream
+    }
+    switch buf[1] {
+        case methodNoAuth:
+        case methodUserPass:
+            user, password := self.config.Username, self.config.Password
+            req := []byte{1, byte(len(user))}
+            req = append(req, user...)
+            req = append(req, byte(len(password)))
+            req = append(req, password...)
+            if _, err := conn.Write(req); err != nil {
+                return err
+            }
+            if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+                return err
+            }
+            if buf[1] != 0 {
+                return fmt.Errorf("socks5 upstream authentication failed")
+            }
+        default:
+            return errSocksUpstream
+    }
+
+    rawaddr, err := socksRawAddr(addr)
+    if err != nil {
+        return err
+    }
+    req := append([]byte{socksVer5, 1, 0}, rawaddr...)
+    if _, err := conn.Write(req); err != nil {
+        return err
+    }
+
+    // Read the reply till the bound address type.
+    if _, err := io.ReadFull(conn, buf[:5]); err != nil {
+        return err
+    }
+    if buf[1] != 0 {
+        return fmt.Errorf("socks5 upstream connect failed with reply %d", buf[1])
+    }
+    var remain int
+    switch buf[3] {
+        case 1:
+            remain = net.IPv4len - 1 + 2
+        case 4:
+            remain = net.IPv6len - 1 + 2
+        case 3:
+            remain = int(buf[4]) + 2
+        default:
+            return errSocksUpstream
+    }
+    _, err = io.ReadFull(conn, buf[:remain])
+    return err
+}
+
+// socksRawAddr converts host:port to the socks address format, starting from
+// the ATYP field.
+func socksRawAddr(addr string) ([]byte, error) {
+    host, portStr, err := net.SplitHostPort(addr)
+    if err != nil {
+        return nil, err
+    }
+    port, err := strconv.Atoi(portStr)
+    if err != nil {
+        return nil, fmt.Errorf("invalid port %s", addr)
+    }
+    var buf []byte
+    if ip := net.ParseIP(host); ip != nil {
+        if ip4 := ip.To4(); ip4 != nil {
+            buf = append([]byte{1}, ip4...)
+        } else {
+            buf = append([]byte{4}, ip.To16()...)
+        }
+    } else {
+        if len(host) > 255 {
+            return nil, fmt.Errorf("host name too long %s", host)
+        }
+        buf = append([]byte{3, byte(len(host))}, host...)
+    }
+    portBuf := make([]byte, 2)
+    binary.BigEndian.PutUint16(portBuf, uint16(port))
+    return append(buf, portBuf...), nil
+}
+
+type HttpOutbound struct {
+    config *OutboundConfig
+}
+
+// bufferedConn keeps the data read ahead while parsing the CONNECT response.
+type bufferedConn struct {
+    net.Conn
+    reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+    return c.reader.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+    return ss.CloseWrite(c.Conn)
+}
+
+func (self *HttpOutbound) Dial(dialer *Dialer, addr string) (net.Conn, error) {
+    conn, err := dialer.Dial("tcp", self.config.Address)
+    if err != nil {
+        return nil, err
+    }
+
+    conn.SetDeadline(time.Now().Add(dialer.timeout))
+    req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+    if self.config.Username != "" {
+        auth := base64.StdEncoding.EncodeToString([]byte(self.config.Username + ":" + self.config.Password))
+        req += "Proxy-Authorization: Basic " + auth + "\r\n"
+    }
+    req += "\r\n"
+    if _, err = conn.Write([]byte(req)); err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    reader := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        conn.Close()
+        return nil, fmt.Errorf("http upstream connect failed with status %v", resp.Status)
+    }
+    conn.SetDeadline(time.Time{})
+    if reader.Buffered() > 0 {
+        return &bufferedConn{Conn: conn, reader: reader}, nil
+    }
+    return conn, nil
+}
+
+// SSPOutbound chains the connections to another ssp server.
+type SSPOutbound struct {
+    config *OutboundConfig
+    headerCipher *ss.Cipher
+}
+
+func NewSSPOutbound(config *OutboundConfig) (*SSPOutbound, error) {
+    if config.Token == "" || config.TokenSecret == "" {
+        return nil, errors.New("Must specify token and token_secret for ssp outbound")
+    }
+    cipher, err := ss.NewCipher(config.Method, config.Password)
+    if err != nil {
+        return nil, err
+    }
+    return &SSPOutbound{config: config, headerCipher: cipher}, nil
+}
+
+func (self *SSPOutbound) GetServerSecret() string {
+    return self.config.Password
+}
+
+func (self *SSPOutbound) GetEncryptMethod() string {
+    return self.config.Method
+}
+
+func (self *SSPOutbound) GetToken() (string, string) {
+    return self.config.Token, self.config.TokenSecret
+}
+
+func (self *SSPOutbound) NewHeaderCipher() *ss.Cipher {
+    return self.headerCipher.Copy()
+}
+
+func (self *SSPOutbound) Dial(dialer *Dialer, addr string) (net.Conn, error) {
+    rawaddr, err := ss.RawAddr(addr)
+    if err != nil {
+        return nil, err
+    }
+    conn, err := dialer.Dial("tcp", self.config.Address)
+    if err != nil {
+        return nil, err
+    }
+    conn.SetDeadline(time.Now().Add(dialer.timeout))
+    c, err := ss.NewClientConnWithRawAddr(conn, rawaddr, self)
+    if err != nil {
+        return nil, err
+    }
+    conn.SetDeadline(time.Time{})
+    return c, nil
+}
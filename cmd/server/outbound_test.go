@@ -0,0 +1,234 @@
+package main
+import (
+    "io"
+    "net"
+    "bufio"
+    "bytes"
+    "testing"
+    "net/http"
+    a "github.com/stretchr/testify/assert"
+)
+
+// fakeUpstream serves a single connection with the handler.
+func fakeUpstream(t *testing.T, handler func(conn net.Conn)) string {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go func() {
+        defer ln.Close()
+        conn, err := ln.Accept()
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        handler(conn)
+    }()
+    return ln.Addr().String()
+}
+
+func newTestDialer(t *testing.T) *Dialer {
+    resolver, err := NewResolver(&ResolverConfig{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    dialer, err := NewDialer(nil, &Config{}, resolver)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return dialer
+}
+
+func TestSocks5Outbound(t *testing.T) {
+    // The request of CONNECT example.com:443.
+    connectReq := append([]byte{5, 1, 0, 3, 11}, "example.com\x01\xbb"...)
+    cases := []struct {
+        name string
+        username string
+        // The method selected by the upstream and the status of the
+        // authentication and the CONNECT request.
+        method byte
+        authStatus byte
+        reply byte
+        ok bool
+    }{
+        {"no auth", "", 0, 0, 0, true},
+        {"auth", "alice", 2, 0, 0, true},
+        {"auth failed", "alice", 2, 1, 0, false},
+        {"no acceptable method", "", 0xff, 0, 0, false},
+        {"connection refused", "", 0, 0, 5, false},
+        {"not allowed", "alice", 2, 0, 2, false},
+    }
+    for _, c := range cases {
+        received := make(chan []byte, 1)
+        addr := fakeUpstream(t, func(conn net.Conn) {
+            var req bytes.Buffer
+            defer func() { received <- req.Bytes() }()
+            r := io.TeeReader(conn, &req)
+            buf := make([]byte, 64)
+            if _, err := io.ReadFull(r, buf[:2]); err != nil {
+                return
+            }
+            io.ReadFull(r, buf[:buf[1]])
+            conn.Write([]byte{5, c.method})
+            if c.method == 2 {
+                // ver, user, password.
+                io.ReadFull(r, buf[:2])
+                io.ReadFull(r, buf[:buf[1]])
+                io.ReadFull(r, buf[:1])
+                io.ReadFull(r, buf[:buf[0]])
+                conn.Write([]byte{1, c.authStatus})
+                if c.authStatus != 0 {
+                    return
+                }
+            } else if c.method != 0 {
+                return
+            }
+            io.ReadFull(r, buf[:len(connectReq)])
+            conn.Write([]byte{5, c.reply, 0, 1, 127, 0, 0, 1, 0x1f, 0x90})
+            if c.reply == 0 {
+                conn.Write([]byte("pong"))
+            }
+        })
+
+        outbound := &Socks5Outbound{config: &OutboundConfig{Address: addr, Username: c.username, Password: "secret"}}
+        conn, err := outbound.Dial(newTestDialer(t), "example.com:443")
+        if !c.ok {
+            a.NotNil(t, err, c.name)
+            <-received
+            continue
+        }
+        if !a.Nil(t, err, c.name) {
+            continue
+        }
+        buf := make([]byte, 4)
+        _, err = io.ReadFull(conn, buf)
+        a.Nil(t, err, c.name)
+        a.Equal(t, "pong", string(buf), c.name)
+        conn.Close()
+
+        req := <-received
+        if c.username == "" {
+            a.Equal(t, append([]byte{5, 1, 0}, connectReq...), req, c.name)
+        } else {
+            auth := append([]byte{5, 2, 0, 2, 1, 5}, "alice\x06secret"...)
+            a.Equal(t, append(auth, connectReq...), req, c.name)
+        }
+    }
+}
+
+func TestHttpOutbound(t *testing.T) {
+    cases := []struct {
+        name string
+        username string
+        response string
+        ok bool
+    }{
+        {"connected", "", "HTTP/1.1 200 Connection established\r\n\r\npong", true},
+        {"auth", "alice", "HTTP/1.1 200 OK\r\n\r\npong", true},
+        {"auth required", "", "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n", false},
+        {"forbidden", "alice", "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n", false},
+        {"not http", "", "SSH-2.0-OpenSSH\r\n", false},
+    }
+    for _, c := range cases {
+        received := make(chan *http.Request, 1)
+        addr := fakeUpstream(t, func(conn net.Conn) {
+            req, err := http.ReadRequest(bufio.NewReader(conn))
+            received <- req
+            if err == nil {
+                conn.Write([]byte(c.response))
+            }
+        })
+
+        outbound := &HttpOutbound{config: &OutboundConfig{Address: addr, Username: c.username, Password: "secret"}}
+        conn, err := outbound.Dial(newTestDialer(t), "example.com:443")
+        req := <-received
+        if a.NotNil(t, req, c.name) {
+            a.Equal(t, "CONNECT", req.Method, c.name)
+            a.Equal(t, "example.com:443", req.Host, c.name)
+            if c.username != "" {
+                a.Equal(t, "Basic YWxpY2U6c2VjcmV0", req.Header.Get("Proxy-Authorization"), c.name)
+            }
+        }
+        if !c.ok {
+            a.NotNil(t, err, c.name)
+            continue
+        }
+        if !a.Nil(t, err, c.name) {
+            continue
+        }
+        // The data after the response is read ahead by the parser.
+        buf := make([]byte, 4)
+        _, err = io.ReadFull(conn, buf)
+        a.Nil(t, err, c.name)
+        a.Equal(t, "pong", string(buf), c.name)
+        conn.Close()
+    }
+}
+
+func TestOutboundRuleMatch(t *testing.T) {
+    cases := []struct {
+        rule *OutboundRule
+        token string
+        host string
+        expected bool
+    }{
+        {&OutboundRule{}, "alice", "example.com", true},
+        {&OutboundRule{Tokens: []string{"alice", "bob"}}, "bob", "example.com", true},
+        {&OutboundRule{Tokens: []string{"alice"}}, "bob", "example.com", false},
+        {&OutboundRule{Domains: []string{".Example.com"}}, "", "www.example.COM", true},
+        {&OutboundRule{Domains: []string{"example.com"}}, "", "example.com", true},
+        {&OutboundRule{Domains: []string{"example.com"}}, "", "badexample.com", false},
+        {&OutboundRule{CIDRs: []string{"10.0.0.0/8"}}, "", "10.1.2.3", true},
+        {&OutboundRule{CIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}}, "", "2001:db8::1", true},
+        {&OutboundRule{CIDRs: []string{"10.0.0.0/8"}}, "", "192.0.2.1", false},
+        {&OutboundRule{CIDRs: []string{"10.0.0.0/8"}}, "", "example.com", false},
+        {&OutboundRule{Tokens: []string{"alice"}, Domains: []string{"example.com"}}, "alice", "example.org", false},
+    }
+    for _, c := range cases {
+        for _, s := range c.rule.CIDRs {
+            ipNet, err := parseIPOrCIDR(s)
+            if err != nil {
+                t.Fatal(err)
+            }
+            c.rule.networks = append(c.rule.networks, ipNet)
+        }
+        a.Equal(t, c.expected, c.rule.Match(c.token, c.host), "%+v %v %v", c.rule, c.token, c.host)
+    }
+}
+
+func TestOutboundManagerSelect(t *testing.T) {
+    config := &Config{
+        Outbounds: map[string]*OutboundConfig{
+            "proxy": {Type: "socks5", Address: "127.0.0.1:1080"},
+            "corp": {Type: "http", Address: "127.0.0.1:3128"},
+        },
+        OutboundRules: []*OutboundRule{
+            {Domains: []string{"corp.example.com"}, Outbound: "corp"},
+            {CIDRs: []string{"10.0.0.0/8"}, Outbound: "corp"},
+            {Tokens: []string{"alice"}, Outbound: "proxy"},
+        },
+    }
+    m, err := NewOutboundManager(config, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // The first matching rule wins, direct if none.
+    a.Equal(t, "corp", m.Select("alice", "git.corp.example.com:22"))
+    a.Equal(t, "corp", m.Select("bob", "10.0.0.1:80"))
+    a.Equal(t, "proxy", m.Select("alice", "example.com:443"))
+    a.Equal(t, directOutboundName, m.Select("bob", "example.com:443"))
+    a.Equal(t, directOutboundName, m.Select("alice", "invalid address"))
+    // Another manager of the config parses the rules again.
+    m, err = NewOutboundManager(config, nil)
+    a.Nil(t, err)
+    a.Len(t, m.rules[1].networks, 1)
+    a.Nil(t, config.OutboundRules[1].networks)
+
+    config.OutboundRules = append(config.OutboundRules, &OutboundRule{Outbound: "missing"})
+    _, err = NewOutboundManager(config, nil)
+    a.NotNil(t, err, "unknown outbound of rules")
+    config.OutboundRules = []*OutboundRule{{CIDRs: []string{"10.0.0.0/33"}, Outbound: "corp"}}
+    _, err = NewOutboundManager(config, nil)
+    a.NotNil(t, err, "invalid cidr")
+}
@@ -0,0 +1,32 @@
+package main
+import (
+    "encoding/json"
+)
+
+type StoreTokensPluginConfig struct {
+    Path string     `json:"path"`
+}
+
+// StoreTokensPlugin looks up tokens in a store of the token subcommands, so
+// created and revoked tokens take effect without restarting.
+type StoreTokensPlugin struct {
+    kind string
+    config StoreTokensPluginConfig
+    store TokenStore
+}
+
+func (self *StoreTokensPlugin) Init(rawJson json.RawMessage) (error) {
+    if err := json.Unmarshal(rawJson, &self.config); err != nil {
+        return err
+    }
+    store, err := OpenTokenStore(self.kind, self.config.Path)
+    if err != nil {
+        return err
+    }
+    self.store = store
+    return nil
+}
+
+func (self *StoreTokensPlugin) GetTokenSecret(token string) (string, error) {
+    return self.store.Get(token)
+}
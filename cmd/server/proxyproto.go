@@ -0,0 +1,155 @@
+package main
+import (
+    "net"
+    "io"
+    "bufio"
+    "bytes"
+    "errors"
+    "strconv"
+    "strings"
+    "encoding/binary"
+    ss "bitbucket.org/qiuyuzhou/shadowsocks/core"
+)
+
+var (
+    errProxyProtocolHeader = errors.New("Invalid PROXY protocol header")
+)
+
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolConn is a connection accepted behind a load balancer, its
+// RemoteAddr and LocalAddr are the ones from the PROXY protocol header.
+type proxyProtocolConn struct {
+    net.Conn
+    reader *bufio.Reader
+    remoteAddr net.Addr
+    localAddr net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+    return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) CloseWrite() error {
+    return ss.CloseWrite(c.Conn)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+    if c.remoteAddr != nil {
+        return c.remoteAddr
+    }
+    return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+    if c.localAddr != nil {
+        return c.localAddr
+    }
+    return c.Conn.LocalAddr()
+}
+
+// readProxyProtocolHeader reads a PROXY protocol v1 or v2 header from conn,
+// and returns a connection which reports the addresses in the header.
+func readProxyProtocolHeader(conn net.Conn) (net.Conn, error) {
+    c := &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}
+    sig, err := c.reader.Peek(len(proxyProtocolV2Sig))
+    if err != nil {
+        return nil, err
+    }
+    if bytes.Equal(sig, proxyProtocolV2Sig) {
+        err = c.readV2()
+    } else if bytes.HasPrefix(sig, []byte("PROXY ")) {
+        err = c.readV1()
+    } else {
+        err = errProxyProtocolHeader
+    }
+    if err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+func (c *proxyProtocolConn) readV1() error {
+    // The v1 header has at most 107 bytes including CRLF.
+    var line []byte
+    for {
+        b, err := c.reader.ReadByte()
+        if err != nil {
+            return err
+        }
+        line = append(line, b)
+        if b == '\n' {
+            break
+        }
+        if len(line) >= 107 {
+            return errProxyProtocolHeader
+        }
+    }
+    if !bytes.HasSuffix(line, []byte("\r\n")) {
+        return errProxyProtocolHeader
+    }
+
+    fields := strings.Split(string(line[:len(line)-2]), " ")
+    if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+        return nil
+    }
+    if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+        return errProxyProtocolHeader
+    }
+    srcIP := net.ParseIP(fields[2])
+    dstIP := net.ParseIP(fields[3])
+    srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+    dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+    if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+        return errProxyProtocolHeader
+    }
+    c.remoteAddr = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+    c.localAddr = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+    return nil
+}
+
+func (c *proxyProtocolConn) readV2() error {
+    const (
+        cmdLocal = 0x20
+        cmdProxy = 0x21
+
+        famTCP4 = 0x11
+        famTCP6 = 0x21
+    )
+    header := make([]byte, 16)
+    if _, err := io.ReadFull(c.reader, header); err != nil {
+        return err
+    }
+    length := int(binary.BigEndian.Uint16(header[14:16]))
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(c.reader, payload); err != nil {
+        return err
+    }
+
+    switch header[12] {
+        case cmdLocal:
+            // Health checks from the proxy itself, keep the real addresses.
+            return nil
+        case cmdProxy:
+        default:
+            return errProxyProtocolHeader
+    }
+
+    switch header[13] {
+        case famTCP4:
+            if length < 12 {
+                return errProxyProtocolHeader
+            }
+            c.remoteAddr = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+            c.localAddr = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+        case famTCP6:
+            if length < 36 {
+                return errProxyProtocolHeader
+            }
+            c.remoteAddr = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+            c.localAddr = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+        default:
+            // UNSPEC or unix sockets, keep the real addresses.
+    }
+    return nil
+}
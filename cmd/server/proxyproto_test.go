@@ -0,0 +1,51 @@
+package main
+import (
+    "testing"
+    "net"
+    "io/ioutil"
+    a "github.com/stretchr/testify/assert"
+)
+
+func readProxyProtocolFrom(t *testing.T, data []byte) (net.Conn, []byte) {
+    client, server := net.Pipe()
+    go func() {
+        client.Write(data)
+        client.Close()
+    }()
+    conn, err := readProxyProtocolHeader(server)
+    if err != nil {
+        t.Fatal("error reading PROXY protocol header:", err)
+    }
+    rest, _ := ioutil.ReadAll(conn)
+    return conn, rest
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+    conn, rest := readProxyProtocolFrom(t, []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\npayload"))
+    a.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+    a.Equal(t, "192.168.0.11:443", conn.LocalAddr().String())
+    a.Equal(t, "payload", string(rest))
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+    header := append([]byte{}, proxyProtocolV2Sig...)
+    header = append(header, 0x21, 0x11, 0x00, 0x0c,
+        10, 0, 0, 1,
+        10, 0, 0, 2,
+        0x1f, 0x90,
+        0x20, 0xcc)
+    conn, rest := readProxyProtocolFrom(t, append(header, []byte("payload")...))
+    a.Equal(t, "10.0.0.1:8080", conn.RemoteAddr().String())
+    a.Equal(t, "10.0.0.2:8396", conn.LocalAddr().String())
+    a.Equal(t, "payload", string(rest))
+}
+
+func TestProxyProtocolInvalid(t *testing.T) {
+    client, server := net.Pipe()
+    go func() {
+        client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+        client.Close()
+    }()
+    _, err := readProxyProtocolHeader(server)
+    a.NotNil(t, err)
+}
@@ -0,0 +1,252 @@
+package main
+import (
+    "net"
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "bufio"
+    "errors"
+    "strings"
+    "sync/atomic"
+    "context"
+    log "github.com/Sirupsen/logrus"
+)
+
+var (
+    errDestinationDenied = errors.New("Destination address is denied.")
+)
+
+type ResolverConfig struct {
+    // Upstream nameservers in host:port, the system ones if empty.
+    Nameservers []string        `json:"nameservers"`
+    // Hosts file which overrides the nameservers, in /etc/hosts format.
+    HostsFile string            `json:"hosts_file"`
+    // One of prefer_ipv4, prefer_ipv6, ipv4_only and ipv6_only, the order of
+    // the nameservers is kept if empty.
+    IPStrategy string           `json:"ip_strategy"`
+    // How long resolved addresses are cached, 60 by default. It is a fixed
+    // lifetime rather than the TTL of the records, which the system resolver
+    // doesn't report.
+    CacheTTLSeconds time.Duration `json:"cache_ttl_seconds"`
+    // Refuse destinations in private, loopback, link local, multicast and
+    // broadcast networks.
+    DenyPrivate bool            `json:"deny_private"`
+}
+
+type resolverCacheEntry struct {
+    ips []net.IP
+    expire time.Time
+}
+
+// Resolver resolves the destination host names of the server with an in
+// memory cache.
+type Resolver struct {
+    config ResolverConfig
+    resolver *net.Resolver
+    hosts map[string][]net.IP
+    next uint32
+
+    mutex sync.Mutex
+    cache map[string]*resolverCacheEntry
+}
+
+var privateNetworks []*net.IPNet
+
+func init() {
+    for _, s := range []string{
+        "0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+        "172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "255.255.255.255/32",
+        "::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+    } {
+        _, ipNet, _ := net.ParseCIDR(s)
+        privateNetworks = append(privateNetworks, ipNet)
+    }
+}
+
+func NewResolver(config *ResolverConfig) (*Resolver, error) {
+    self := &Resolver{
+        resolver: net.DefaultResolver,
+        hosts: make(map[string][]net.IP),
+        cache: make(map[string]*resolverCacheEntry),
+    }
+    if config != nil {
+        self.config = *config
+    }
+    switch self.config.IPStrategy {
+        case "", "prefer_ipv4", "prefer_ipv6", "ipv4_only", "ipv6_only":
+        default:
+            return nil, fmt.Errorf("Unknown ip strategy %v", self.config.IPStrategy)
+    }
+    if self.config.CacheTTLSeconds <= 0 {
+        self.config.CacheTTLSeconds = 60
+    }
+    if len(self.config.Nameservers) > 0 {
+        for i, ns := range self.config.Nameservers {
+            if _, _, err := net.SplitHostPort(ns); err != nil {
+                self.config.Nameservers[i] = net.JoinHostPort(ns, "53")
+            }
+        }
+        self.resolver = &net.Resolver{PreferGo: true, Dial: self.dialNameserver}
+    }
+    if self.config.HostsFile != "" {
+        if err := self.loadHostsFile(self.config.HostsFile); err != nil {
+            return nil, err
+        }
+    }
+    return self, nil
+}
+
+// dialNameserver rotates the upstream nameservers on every attempt of the Go
+// resolver, so that a dead one is skipped on retry.
+func (self *Resolver) dialNameserver(ctx context.Context, network, address string) (net.Conn, error) {
+    i := atomic.AddUint32(&self.next, 1) - 1
+    ns := self.config.Nameservers[i%uint32(len(self.config.Nameservers))]
+    d := net.Dialer{}
+    return d.DialContext(ctx, network, ns)
+}
+
+func (self *Resolver) loadHostsFile(path string) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if i := strings.IndexByte(line, '#'); i >= 0 {
+            line = line[:i]
+        }
+        fields := strings.Fields(line)
+        if len(fields) < 2 {
+            continue
+        }
+        ip := net.ParseIP(fields[0])
+        if ip == nil {
+            continue
+        }
+        for _, name := range fields[1:] {
+            name = strings.ToLower(strings.TrimSuffix(name, "."))
+            self.hosts[name] = append(self.hosts[name], ip)
+        }
+    }
+    return scanner.Err()
+}
+
+// LookupIP returns the addresses of host ordered and filtered by the ip
+// strategy, host may also be an IP address.
+func (self *Resolver) LookupIP(host string) ([]net.IP, error) {
+    var ips []net.IP
+    if ip := net.ParseIP(host); ip != nil {
+        ips = []net.IP{ip}
+    } else {
+        var err error
+        if ips, err = self.lookupHost(strings.ToLower(strings.TrimSuffix(host, "."))); err != nil {
+            return nil, err
+        }
+    }
+
+    ips = self.sortIPs(ips)
+    if len(ips) == 0 {
+        return nil, &net.DNSError{Err: "no suitable address found", Name: host}
+    }
+    return ips, nil
+}
+
+// LookupDestinationIP is like LookupIP, but also applies the destination ACL
+// for the addresses requested by clients.
+func (self *Resolver) LookupDestinationIP(host string) ([]net.IP, error) {
+    ips, err := self.LookupIP(host)
+    if err != nil || !self.config.DenyPrivate {
+        return ips, err
+    }
+    allowed := make([]net.IP, 0, len(ips))
+    for _, ip := range ips {
+        if !isPrivateIP(ip) {
+            allowed = append(allowed, ip)
+        }
+    }
+    if len(allowed) == 0 {
+        log.WithField("host", host).Debug("Deny destination in private networks")
+        return nil, errDestinationDenied
+    }
+    return allowed, nil
+}
+
+func (self *Resolver) lookupHost(host string) ([]net.IP, error) {
+    if ips, ok := self.hosts[host]; ok {
+        return ips, nil
+    }
+
+    now := time.Now()
+    self.mutex.Lock()
+    entry, ok := self.cache[host]
+    if ok && now.After(entry.expire) {
+        delete(self.cache, host)
+        ok = false
+    }
+    self.mutex.Unlock()
+    if ok {
+        return entry.ips, nil
+    }
+
+    addrs, err := self.resolver.LookupIPAddr(context.Background(), host)
+    if err != nil {
+        return nil, err
+    }
+    ips := make([]net.IP, 0, len(addrs))
+    for _, addr := range addrs {
+        ips = append(ips, addr.IP)
+    }
+
+    self.mutex.Lock()
+    self.cache[host] = &resolverCacheEntry{ips: ips, expire: now.Add(self.config.CacheTTLSeconds * time.Second)}
+    if len(self.cache) > 1024 {
+        self.purgeExpired(now)
+    }
+    self.mutex.Unlock()
+    return ips, nil
+}
+
+// purgeExpired must be called with the mutex locked.
+func (self *Resolver) purgeExpired(now time.Time) {
+    for host, entry := range self.cache {
+        if now.After(entry.expire) {
+            delete(self.cache, host)
+        }
+    }
+}
+
+func (self *Resolver) sortIPs(ips []net.IP) []net.IP {
+    if self.config.IPStrategy == "" {
+        return ips
+    }
+    var ipv4s, ipv6s []net.IP
+    for _, ip := range ips {
+        if ip.To4() != nil {
+            ipv4s = append(ipv4s, ip)
+        } else {
+            ipv6s = append(ipv6s, ip)
+        }
+    }
+    switch self.config.IPStrategy {
+        case "ipv4_only":
+            return ipv4s
+        case "ipv6_only":
+            return ipv6s
+        case "prefer_ipv6":
+            return append(ipv6s, ipv4s...)
+    }
+    return append(ipv4s, ipv6s...)
+}
+
+func isPrivateIP(ip net.IP) bool {
+    for _, ipNet := range privateNetworks {
+        if ipNet.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,47 @@
+package main
+import (
+    "net"
+    "testing"
+    a "github.com/stretchr/testify/assert"
+)
+
+func TestResolverHostsFile(t *testing.T) {
+    r, err := NewResolver(&ResolverConfig{
+        HostsFile: "testdata/hosts",
+        IPStrategy: "prefer_ipv6",
+        DenyPrivate: true,
+    })
+    a.Nil(t, err)
+
+    ips, err := r.LookupDestinationIP("Example.com")
+    a.Nil(t, err)
+    if a.Len(t, ips, 2) {
+        a.Equal(t, "2001:db8::10", ips[0].String())
+        a.Equal(t, "203.0.113.10", ips[1].String())
+    }
+
+    _, err = r.LookupDestinationIP("intranet.example.com")
+    a.Equal(t, errDestinationDenied, err)
+    _, err = r.LookupDestinationIP("127.0.0.1")
+    a.Equal(t, errDestinationDenied, err)
+    ips, err = r.LookupIP("intranet.example.com")
+    a.Nil(t, err)
+    a.Len(t, ips, 1)
+}
+
+func TestIsPrivateIP(t *testing.T) {
+    for ip, private := range map[string]bool{
+        "10.1.2.3": true,
+        "127.0.0.1": true,
+        "169.254.1.1": true,
+        "224.0.0.251": true,
+        "239.255.255.250": true,
+        "255.255.255.255": true,
+        "fe80::1": true,
+        "ff02::1": true,
+        "203.0.113.10": false,
+        "2001:db8::10": false,
+    } {
+        a.Equal(t, private, isPrivateIP(net.ParseIP(ip)), ip)
+    }
+}
@@ -1,12 +1,14 @@
 package main
 import (
     "net"
+    "errors"
     log "github.com/Sirupsen/logrus"
     "os"
     ss "bitbucket.org/qiuyuzhou/shadowsocks/core"
     "syscall"
     "sync"
     "sync/atomic"
+    "time"
     "os/signal"
     "github.com/codegangsta/cli"
 )
@@ -21,9 +23,33 @@ func init() {
 
 var config *Config
 var tokensManager *TokensManager
+var resolver *Resolver
+var outboundManager *OutboundManager
+var banner *Banner
+var auditLogger *AuditLogger
 
 var connCount int32
 
+// connectStatus maps the error of dialing the destination to the status sent
+// to clients with the connect status extension.
+func connectStatus(err error) byte {
+    var dnsErr *net.DNSError
+    switch {
+        case err == errDestinationDenied:
+            return ss.ConnectStatusDenied
+        case errors.As(err, &dnsErr):
+            return ss.ConnectStatusDNSFailure
+        case errors.Is(err, syscall.ECONNREFUSED):
+            return ss.ConnectStatusRefused
+        case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+            return ss.ConnectStatusUnreachable
+    }
+    if ne, ok := err.(net.Error); ok && ne.Timeout() {
+        return ss.ConnectStatusUnreachable
+    }
+    return ss.ConnectStatusFailure
+}
+
 func handleConnection(rawConn net.Conn) {
     var conn *ss.Conn
     var err error
@@ -38,8 +64,13 @@ func handleConnection(rawConn net.Conn) {
             conn.Close()
         }
     }()
+    // The deadline covers the ssp handshake and the request.
+    conn.SetDeadline(time.Now().Add(config.GetHandshakeTimeout()))
     if err := conn.HandShake(); err != nil {
-        log.Error("error handshake: ", err)
+        log.WithField("src", conn.RemoteAddr()).Error("error handshake: ", err)
+        if banner != nil {
+            banner.RecordFailure(conn.RemoteAddr())
+        }
         return
     }
 
@@ -48,9 +79,10 @@ func handleConnection(rawConn net.Conn) {
         log.Error("error getting request", conn.RemoteAddr(), conn.LocalAddr(), err)
         return
     }
+    conn.SetDeadline(time.Time{})
 //    log.Debug("getting request: ", host)
 
-    remote, err := net.Dial("tcp", host)
+    remote, err := outboundManager.Dial(conn.Token(), host)
     if err != nil {
         if ne, ok := err.(*net.OpError); ok && (ne.Err == syscall.EMFILE || ne.Err == syscall.ENFILE) {
             // log too many open file error
@@ -59,6 +91,7 @@ func handleConnection(rawConn net.Conn) {
         } else {
             log.Debug("error connecting to:", host, err)
         }
+        conn.WriteConnectStatus(connectStatus(err))
         return
     }
     defer func() {
@@ -66,6 +99,10 @@ func handleConnection(rawConn net.Conn) {
             remote.Close()
         }
     }()
+    if err = conn.WriteConnectStatus(ss.ConnectStatusSuccess); err != nil {
+        log.Debug("write connect status error:", err)
+        return
+    }
     // write extra bytes read from
     if extra != nil {
         // debug.Println("getRequest read extra data, writing to remote, len", len(extra))
@@ -78,18 +115,43 @@ func handleConnection(rawConn net.Conn) {
     log.WithField("addr", host).Infof("Proxy connection to %v", host)
 //    log.Debugf("piping %s<->%s", conn.RemoteAddr(), host)
 
-    go ss.PipeThenClose(conn, remote)
-    ss.PipeThenClose(remote, conn)
+    var timer *ss.IdleTimer
+    if config.Timeout > 0 {
+        timer = ss.NewIdleTimer(time.Duration(config.Timeout) * time.Second)
+    }
+    start := time.Now()
+    up, down := ss.Relay(conn, remote, timer, config.GetLingerTimeout())
     closed = true
+
+    if auditLogger != nil {
+        end := up.End
+        if down.End.After(end) {
+            end = down.End
+        }
+        auditLogger.Log(&AuditRecord{
+            Token: conn.Token(),
+            Src: conn.RemoteAddr().String(),
+            Dst: host,
+            BytesUp: up.Written,
+            BytesDown: down.Written,
+            Start: start,
+            End: end,
+            CloseReason: closeReason(up, down),
+        })
+    }
 //    log.Debug("closed connection to", host)
 }
 
 func waitSignal() {
     var sigChan = make(chan os.Signal, 1)
-    signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGINT)
+    signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGUSR1)
     for sig := range sigChan {
         if sig == syscall.SIGHUP {
 //            updatePasswd()
+        } else if sig == syscall.SIGUSR1 {
+            if banner != nil {
+                banner.LogBans()
+            }
         } else {
             // is this going to happen?
             log.Printf("caught signal %v, exit\n", sig)
@@ -98,23 +160,60 @@ func waitSignal() {
     }
 }
 
+// rejectBanned closes the connection if it comes from a banned address.
+func rejectBanned(conn net.Conn) bool {
+    if banner != nil && banner.IsBanned(conn.RemoteAddr()) {
+        log.WithField("src", conn.RemoteAddr()).Debug("Reject connection from banned address")
+        conn.Close()
+        return true
+    }
+    return false
+}
+
+func handleProxyProtocolConnection(rawConn net.Conn) {
+    rawConn.SetReadDeadline(time.Now().Add(config.GetHandshakeTimeout()))
+    conn, err := readProxyProtocolHeader(rawConn)
+    if err != nil {
+        log.WithField("src", rawConn.RemoteAddr()).Error("error reading PROXY protocol header: ", err)
+        rawConn.Close()
+        return
+    }
+    rawConn.SetReadDeadline(time.Time{})
+    if rejectBanned(conn) {
+        return
+    }
+    handleConnection(conn)
+}
+
 func run() {
     var wg sync.WaitGroup
-    for _, el:= range config.Listen {
+    for _, el:= range config.GetListeners() {
         wg.Add(1)
-        go func(laddr string){
+        go func(lc *ListenerConfig){
             defer wg.Done()
+            laddr := lc.Address
             ln, err := net.Listen("tcp", laddr)
             if err != nil {
                 log.Fatalf("error listening at %v: %v", laddr, err)
             }
-            log.WithField("listen", laddr).Infof("server listening on %v ...", laddr)
+            log.WithFields(log.Fields{
+                "listen": laddr,
+                "proxy_protocol": lc.ProxyProtocol,
+            }).Infof("server listening on %v ...", laddr)
             for {
                 conn, err := ln.Accept()
                 if err != nil {
                     log.Errorf("accept error: %v", err)
                     continue
                 }
+                if lc.ProxyProtocol {
+                    // The real client address is known after the header.
+                    go handleProxyProtocolConnection(conn)
+                    continue
+                }
+                if rejectBanned(conn) {
+                    continue
+                }
                 // Creating cipher upon first connection.
                 go handleConnection(conn)
             }
@@ -142,6 +241,8 @@ func main() {
         },
     }
 
+    app.Commands = []cli.Command{tokenCommand}
+
     app.Action = func(c *cli.Context) {
         if c.GlobalBool("debug") {
             log.SetLevel(log.DebugLevel)
@@ -172,6 +273,35 @@ func main() {
                 os.Exit(1)
             }
         }
+        {
+            var err error
+            resolver, err = NewResolver(config.Resolver)
+            if err != nil {
+                log.Errorf("Initial Resolver failed with error: %v", err)
+                os.Exit(1)
+            }
+            outboundManager, err = NewOutboundManager(config, resolver)
+            if err != nil {
+                log.Errorf("Initial OutboundManager failed with error: %v", err)
+                os.Exit(1)
+            }
+        }
+        if config.Ban != nil {
+            var err error
+            banner, err = NewBanner(config.Ban)
+            if err != nil {
+                log.Errorf("Initial Banner failed with error: %v", err)
+                os.Exit(1)
+            }
+        }
+        if config.AuditLog != nil {
+            var err error
+            auditLogger, err = NewAuditLogger(config.AuditLog)
+            if err != nil {
+                log.Errorf("Initial AuditLogger failed with error: %v", err)
+                os.Exit(1)
+            }
+        }
 
         run()
     }
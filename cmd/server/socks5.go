@@ -30,7 +30,6 @@ func getRequest(conn *ss.Conn) (host string, extra []byte, err error) {
     buf := make([]byte, 260)
     var n int
     // read till we get possible domain length field
-//    ss.SetReadTimeout(conn)
     if n, err = io.ReadAtLeast(conn, buf, idDmLen+1); err != nil {
         return
     }
@@ -0,0 +1,195 @@
+package main
+import (
+    "os"
+    "fmt"
+    "net"
+    "github.com/codegangsta/cli"
+    log "github.com/Sirupsen/logrus"
+    ss "bitbucket.org/qiuyuzhou/shadowsocks/core"
+)
+
+var tokenStoreFlags = []cli.Flag{
+    cli.StringFlag{
+        Name: "file,f",
+        Usage: "The JSON file of tokens, same as the file tokens plugin",
+    },
+    cli.StringFlag{
+        Name: "sqlite",
+        Usage: "The sqlite database of tokens, same as the sqlite tokens plugin",
+    },
+}
+
+// tokenCommand manages the tokens in the stores read by the file and sqlite
+// tokens plugins.
+var tokenCommand = cli.Command{
+    Name: "token",
+    Usage: "Manage the tokens of a file or sqlite store",
+    Subcommands: []cli.Command{
+        {
+            Name: "new",
+            Usage: "Create a token with a random secret, the token is random if not given",
+            Flags: append([]cli.Flag{
+                cli.IntFlag{
+                    Name: "length",
+                    Value: ss.TOKEN_SIZE - 2,
+                    Usage: fmt.Sprintf("Length of the random token, at most %v, or %v to use connect_status", ss.TOKEN_SIZE, ss.TOKEN_SIZE-2),
+                },
+            }, tokenStoreFlags...),
+            Action: tokenNew,
+        },
+        {
+            Name: "list",
+            Usage: "List the tokens",
+            Flags: tokenStoreFlags,
+            Action: tokenList,
+        },
+        {
+            Name: "revoke",
+            Usage: "Revoke the token",
+            Flags: tokenStoreFlags,
+            Action: tokenRevoke,
+        },
+        {
+            Name: "url",
+            Usage: "Print the ssp:// url of the token, with the method and password of the server config",
+            Flags: append([]cli.Flag{
+                cli.StringFlag{
+                    Name: "config,c",
+                    Usage: "The server config file, the global --config by default",
+                },
+                cli.StringFlag{
+                    Name: "address,a",
+                    Usage: "The address clients connect to, the first listen address by default",
+                },
+            }, tokenStoreFlags...),
+            Action: tokenUrl,
+        },
+    },
+}
+
+func openTokenStoreFlag(c *cli.Context) TokenStore {
+    var store TokenStore
+    var err error
+    switch {
+        case c.String("file") != "" && c.String("sqlite") != "":
+            err = fmt.Errorf("Must specify only one of --file and --sqlite")
+        case c.String("file") != "":
+            store, err = OpenTokenStore("file", c.String("file"))
+        case c.String("sqlite") != "":
+            store, err = OpenTokenStore("sqlite", c.String("sqlite"))
+        default:
+            err = fmt.Errorf("Must specify the token store by --file or --sqlite")
+    }
+    if err != nil {
+        log.Error(err)
+        os.Exit(1)
+    }
+    return store
+}
+
+func tokenNew(c *cli.Context) {
+    store := openTokenStoreFlag(c)
+    defer store.Close()
+
+    token := c.Args().First()
+    var err error
+    if token == "" {
+        token, err = newToken(c.Int("length"))
+    } else if len(token) > ss.TOKEN_SIZE {
+        err = fmt.Errorf("Token length must be less equal %v", ss.TOKEN_SIZE)
+    }
+    if err != nil {
+        log.Error(err)
+        os.Exit(1)
+    }
+    secret, err := newTokenSecret()
+    if err == nil {
+        err = store.Add(token, secret)
+    }
+    if err != nil {
+        log.Error(err)
+        os.Exit(1)
+    }
+    fmt.Printf("%v\t%v\n", token, secret)
+}
+
+func tokenList(c *cli.Context) {
+    store := openTokenStoreFlag(c)
+    defer store.Close()
+
+    tokens, err := store.List()
+    if err != nil {
+        log.Error(err)
+        os.Exit(1)
+    }
+    for _, token := range tokens {
+        fmt.Println(token)
+    }
+}
+
+func tokenRevoke(c *cli.Context) {
+    if !c.Args().Present() {
+        log.Error("Must specify the token to revoke")
+        os.Exit(1)
+    }
+    store := openTokenStoreFlag(c)
+    defer store.Close()
+
+    for _, token := range c.Args() {
+        if err := store.Revoke(token); err != nil {
+            log.WithField("token", token).Error(err)
+            os.Exit(1)
+        }
+    }
+}
+
+func tokenUrl(c *cli.Context) {
+    token := c.Args().First()
+    if token == "" {
+        log.Error("Must specify the token")
+        os.Exit(1)
+    }
+    configFile := c.String("config")
+    if configFile == "" {
+        configFile = c.GlobalString("config")
+    }
+    if configFile == "" {
+        log.Error("Must specify config file.")
+        os.Exit(1)
+    }
+    config, err := ParseConfig(configFile)
+    if err != nil {
+        log.Error(err)
+        os.Exit(1)
+    }
+    store := openTokenStoreFlag(c)
+    defer store.Close()
+    secret, err := store.Get(token)
+    if err != nil {
+        log.WithField("token", token).Error(err)
+        os.Exit(1)
+    }
+
+    address := c.String("address")
+    if address == "" {
+        if listeners := config.GetListeners(); len(listeners) > 0 {
+            address = listeners[0].Address
+        }
+    }
+    host, _, err := net.SplitHostPort(address)
+    if ip := net.ParseIP(host); err == nil && (host == "" || (ip != nil && ip.IsUnspecified())) {
+        err = fmt.Errorf("Must specify the address clients connect to by --address, instead of %q", address)
+    }
+    if err != nil {
+        log.Error(err)
+        os.Exit(1)
+    }
+    u := &ss.SSPUrl{
+        Method: config.Method,
+        Password: config.Password,
+        Address: address,
+        Token: token,
+        TokenSecret: secret,
+    }
+    fmt.Println(u.String())
+}
@@ -30,6 +30,8 @@ func NewTokensManager(config *Config) (*TokensManager, error) {
                 plugin = &SimpleTokensPlugin{}
             case "remote":
                 plugin = &RemoteTokensPlugin{}
+            case "file", "sqlite":
+                plugin = &StoreTokensPlugin{kind: key}
             default:
                 log.WithField("plugin", key).Warn("Unkown tokens plugin")
                 continue
@@ -0,0 +1,287 @@
+package main
+import (
+    "os"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "errors"
+    "math/big"
+    "io/ioutil"
+    "crypto/rand"
+    "database/sql"
+    "path/filepath"
+    "encoding/json"
+    "encoding/base64"
+    _ "github.com/mattn/go-sqlite3"
+    ss "bitbucket.org/qiuyuzhou/shadowsocks/core"
+)
+
+var (
+    errTokenExists = errors.New("The token exists.")
+)
+
+// TokenStore keeps tokens and their secrets, which are created and revoked
+// by the token subcommands while the server reads them.
+type TokenStore interface {
+    Get(token string) (string, error)
+    Add(token, secret string) error
+    Revoke(token string) error
+    // List returns the tokens sorted.
+    List() ([]string, error)
+    Close() error
+}
+
+// OpenTokenStore opens a store of the kind, file or sqlite, creating it if
+// it doesn't exist.
+func OpenTokenStore(kind, path string) (TokenStore, error) {
+    if path == "" {
+        return nil, fmt.Errorf("Must specify path of %v token store", kind)
+    }
+    switch kind {
+        case "file":
+            return &fileTokenStore{path: path}, nil
+        case "sqlite":
+            return openSqliteTokenStore(path)
+    }
+    return nil, fmt.Errorf("Unknown token store %q", kind)
+}
+
+// fileTokenStore is a JSON file of tokens to secrets, in the same format as
+// the simple tokens plugin. It is read again when modified.
+type fileTokenStore struct {
+    path string
+
+    mutex sync.Mutex
+    modTime time.Time
+    size int64
+    tokens map[string]string
+}
+
+func (self *fileTokenStore) load() (map[string]string, error) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+    stat, err := os.Stat(self.path)
+    if os.IsNotExist(err) {
+        return map[string]string{}, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if self.tokens != nil && self.modTime.Equal(stat.ModTime()) && self.size == stat.Size() {
+        return self.tokens, nil
+    }
+    data, err := ioutil.ReadFile(self.path)
+    if err != nil {
+        return nil, err
+    }
+    tokens := map[string]string{}
+    if err = json.Unmarshal(data, &tokens); err != nil {
+        return nil, fmt.Errorf("Invalid token store %v: %v", self.path, err)
+    }
+    self.tokens = tokens
+    self.modTime = stat.ModTime()
+    self.size = stat.Size()
+    return tokens, nil
+}
+
+// save replaces the file through a temporary file, so the server never reads
+// it half written.
+func (self *fileTokenStore) save(tokens map[string]string) error {
+    data, err := json.MarshalIndent(tokens, "", "  ")
+    if err != nil {
+        return err
+    }
+    tmp, err := ioutil.TempFile(filepath.Dir(self.path), filepath.Base(self.path) + ".")
+    if err != nil {
+        return err
+    }
+    if _, err = tmp.Write(append(data, '\n')); err == nil {
+        err = tmp.Close()
+    } else {
+        tmp.Close()
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), self.path)
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+    // The modification time may not change within its resolution.
+    if stat, err := os.Stat(self.path); err == nil {
+        self.mutex.Lock()
+        self.tokens = tokens
+        self.modTime = stat.ModTime()
+        self.size = stat.Size()
+        self.mutex.Unlock()
+    }
+    return nil
+}
+
+func (self *fileTokenStore) Get(token string) (string, error) {
+    tokens, err := self.load()
+    if err != nil {
+        return "", err
+    }
+    secret, ok := tokens[token]
+    if !ok {
+        return "", errNotFoundToken
+    }
+    return secret, nil
+}
+
+// update copies the tokens, so that the cached map is never modified.
+func (self *fileTokenStore) update(f func(tokens map[string]string) error) error {
+    current, err := self.load()
+    if err != nil {
+        return err
+    }
+    tokens := make(map[string]string, len(current)+1)
+    for k, v := range current {
+        tokens[k] = v
+    }
+    if err = f(tokens); err != nil {
+        return err
+    }
+    return self.save(tokens)
+}
+
+func (self *fileTokenStore) Add(token, secret string) error {
+    return self.update(func(tokens map[string]string) error {
+        if _, ok := tokens[token]; ok {
+            return errTokenExists
+        }
+        tokens[token] = secret
+        return nil
+    })
+}
+
+func (self *fileTokenStore) Revoke(token string) error {
+    return self.update(func(tokens map[string]string) error {
+        if _, ok := tokens[token]; !ok {
+            return errNotFoundToken
+        }
+        delete(tokens, token)
+        return nil
+    })
+}
+
+func (self *fileTokenStore) List() ([]string, error) {
+    tokens, err := self.load()
+    if err != nil {
+        return nil, err
+    }
+    list := make([]string, 0, len(tokens))
+    for token := range tokens {
+        list = append(list, token)
+    }
+    sort.Strings(list)
+    return list, nil
+}
+
+func (self *fileTokenStore) Close() error {
+    return nil
+}
+
+type sqliteTokenStore struct {
+    db *sql.DB
+}
+
+func openSqliteTokenStore(path string) (*sqliteTokenStore, error) {
+    // Wait for the locks of the other processes using the database.
+    db, err := sql.Open("sqlite3", "file:" + path + "?_busy_timeout=5000")
+    if err != nil {
+        return nil, err
+    }
+    _, err = db.Exec(`CREATE TABLE IF NOT EXISTS tokens (
+        token TEXT PRIMARY KEY,
+        secret TEXT NOT NULL,
+        created_at INTEGER NOT NULL
+    )`)
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    return &sqliteTokenStore{db: db}, nil
+}
+
+func (self *sqliteTokenStore) Get(token string) (string, error) {
+    var secret string
+    err := self.db.QueryRow("SELECT secret FROM tokens WHERE token = ?", token).Scan(&secret)
+    if err == sql.ErrNoRows {
+        return "", errNotFoundToken
+    }
+    return secret, err
+}
+
+func (self *sqliteTokenStore) Add(token, secret string) error {
+    result, err := self.db.Exec("INSERT OR IGNORE INTO tokens (token, secret, created_at) VALUES (?, ?, ?)", token, secret, time.Now().Unix())
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err == nil && n == 0 {
+        return errTokenExists
+    }
+    return nil
+}
+
+func (self *sqliteTokenStore) Revoke(token string) error {
+    result, err := self.db.Exec("DELETE FROM tokens WHERE token = ?", token)
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err == nil && n == 0 {
+        return errNotFoundToken
+    }
+    return nil
+}
+
+func (self *sqliteTokenStore) List() ([]string, error) {
+    rows, err := self.db.Query("SELECT token FROM tokens ORDER BY token")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var list []string
+    for rows.Next() {
+        var token string
+        if err = rows.Scan(&token); err != nil {
+            return nil, err
+        }
+        list = append(list, token)
+    }
+    return list, rows.Err()
+}
+
+func (self *sqliteTokenStore) Close() error {
+    return self.db.Close()
+}
+
+const tokenChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// newToken returns a random alphanumeric token of the length, which is at
+// most TOKEN_SIZE.
+func newToken(length int) (string, error) {
+    if length <= 0 || length > ss.TOKEN_SIZE {
+        return "", fmt.Errorf("Token length must be between 1 and %v", ss.TOKEN_SIZE)
+    }
+    token := make([]byte, length)
+    for i := range token {
+        n, err := rand.Int(rand.Reader, big.NewInt(int64(len(tokenChars))))
+        if err != nil {
+            return "", err
+        }
+        token[i] = tokenChars[n.Int64()]
+    }
+    return string(token), nil
+}
+
+// newTokenSecret returns 256 random bits in URL safe base64.
+func newTokenSecret() (string, error) {
+    secret := make([]byte, 32)
+    if _, err := rand.Read(secret); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(secret), nil
+}
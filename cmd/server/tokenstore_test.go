@@ -0,0 +1,59 @@
+package main
+import (
+    "os"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+    a "github.com/stretchr/testify/assert"
+    ss "bitbucket.org/qiuyuzhou/shadowsocks/core"
+)
+
+func TestTokenStores(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tokens")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    for kind, path := range map[string]string{"file": "tokens.json", "sqlite": "tokens.db"} {
+        path = filepath.Join(dir, path)
+        store, err := OpenTokenStore(kind, path)
+        if err != nil {
+            t.Fatal(kind, err)
+        }
+        a.Nil(t, store.Add("charlie", "secret"), kind)
+        a.Nil(t, store.Add("alice", "alice_secret"), kind)
+        a.Equal(t, errTokenExists, store.Add("charlie", "other"), kind)
+        tokens, err := store.List()
+        a.Nil(t, err, kind)
+        a.Equal(t, []string{"alice", "charlie"}, tokens, kind)
+        a.Nil(t, store.Close(), kind)
+
+        // Read by the server through the plugin.
+        plugin := &StoreTokensPlugin{kind: kind}
+        a.Nil(t, plugin.Init([]byte(`{"path": "` + path + `"}`)), kind)
+        secret, err := plugin.GetTokenSecret("charlie")
+        a.Nil(t, err, kind)
+        a.Equal(t, "secret", secret, kind)
+
+        store, _ = OpenTokenStore(kind, path)
+        a.Nil(t, store.Revoke("charlie"), kind)
+        a.Equal(t, errNotFoundToken, store.Revoke("charlie"), kind)
+        store.Close()
+        _, err = plugin.GetTokenSecret("charlie")
+        a.Equal(t, errNotFoundToken, err, kind)
+    }
+}
+
+func TestNewToken(t *testing.T) {
+    token, err := newToken(ss.TOKEN_SIZE - 2)
+    a.Nil(t, err)
+    a.Equal(t, ss.TOKEN_SIZE - 2, len(token))
+    _, err = newToken(ss.TOKEN_SIZE + 1)
+    a.NotNil(t, err)
+
+    secret, err := newTokenSecret()
+    a.Nil(t, err)
+    a.Equal(t, 43, len(secret))
+
+}
@@ -8,10 +8,57 @@ import (
     "strconv"
     "errors"
     "bytes"
+    "time"
 )
 
 const TOKEN_SIZE = 16
 
+// Protocol extensions, negotiated by the flags in the last byte of the token
+// header. Servers which don't know them ignore everything after the NUL
+// padding of the token, so tokens must be at most TOKEN_SIZE-2 bytes long to
+// use extensions.
+const (
+    // The server sends a status byte after connecting to the destination,
+    // following connectStatusAck and the flags of the extensions it accepts.
+    ExtConnectStatus byte = 1 << 0
+
+    supportedExtensions = ExtConnectStatus
+)
+
+// connectStatusAck starts the status sent by servers supporting
+// ExtConnectStatus. Servers which don't support it send the data of the
+// destination instead, which the client reads as usual, but only once the
+// destination sends some.
+var connectStatusAck = []byte{0xc5, 0x5c}
+
+// Status of connecting to the destination, sent by the server with the
+// ExtConnectStatus extension.
+const (
+    ConnectStatusSuccess byte = iota
+    ConnectStatusRefused
+    ConnectStatusUnreachable
+    ConnectStatusDenied
+    ConnectStatusDNSFailure
+    ConnectStatusFailure
+)
+
+var (
+    ErrConnectRefused     = errors.New("shadowsocks: connection refused by destination")
+    ErrHostUnreachable    = errors.New("shadowsocks: destination unreachable")
+    ErrConnectDenied      = errors.New("shadowsocks: destination denied by server")
+    ErrDNSFailure         = errors.New("shadowsocks: destination name resolution failed")
+    ErrConnectFailed      = errors.New("shadowsocks: connecting to destination failed")
+    errTokenTooLongForExt = errors.New("shadowsocks: token too long to use protocol extensions")
+)
+
+var connectStatusErrors = map[byte]error{
+    ConnectStatusRefused: ErrConnectRefused,
+    ConnectStatusUnreachable: ErrHostUnreachable,
+    ConnectStatusDenied: ErrConnectDenied,
+    ConnectStatusDNSFailure: ErrDNSFailure,
+    ConnectStatusFailure: ErrConnectFailed,
+}
+
 type PasswordQueryFn func(tokenId string)string
 
 type BaseEncryptConfig interface {
@@ -25,6 +72,13 @@ type ClientEncryptConfig interface {
     GetToken()(string, string)
 }
 
+// ExtendedClientEncryptConfig is implemented by client configs which request
+// protocol extensions.
+type ExtendedClientEncryptConfig interface {
+    ClientEncryptConfig
+    GetExtensions() byte
+}
+
 type ServerEncryptConfig interface {
     BaseEncryptConfig
     GetTokenSecret(token string)(string, error)
@@ -36,6 +90,11 @@ type Conn struct {
     bodyCipher    *Cipher
     serverEncryptConfig ServerEncryptConfig
     clientEncryptConfig ClientEncryptConfig
+    token    string
+    extensions byte
+    // Data read while looking for the connect status of servers which don't
+    // acknowledge the extension.
+    pending  []byte
     readBuf  []byte
     writeBuf []byte
 }
@@ -86,23 +145,102 @@ func RawAddr(addr string) (buf []byte, err error) {
 // rawaddr shoud contain part of the data in socks request, starting from the
 // ATYP field. (Refer to rfc1928 for more information.)
 func DialWithRawAddr(rawaddr []byte, server string, encryptConfig ClientEncryptConfig) (c *Conn, err error) {
+    return DialWithRawAddrTimeout(rawaddr, server, encryptConfig, 0)
+}
+
+// DialWithRawAddrTimeout is like DialWithRawAddr, but the timeout covers both
+// connecting to the server and the handshake. There's no timeout if 0.
+func DialWithRawAddrTimeout(rawaddr []byte, server string, encryptConfig ClientEncryptConfig, timeout time.Duration) (c *Conn, err error) {
     var conn net.Conn
-    if conn, err = net.Dial("tcp", server); err != nil {
+    if conn, err = net.DialTimeout("tcp", server, timeout); err != nil {
         return
     }
+    if timeout > 0 {
+        conn.SetDeadline(time.Now().Add(timeout))
+    }
+    if c, err = NewClientConnWithRawAddr(conn, rawaddr, encryptConfig); err != nil {
+        return
+    }
+    if timeout > 0 {
+        conn.SetDeadline(time.Time{})
+    }
+    return
+}
+
+// NewClientConnWithRawAddr is like DialWithRawAddr, but over a connection to
+// the server which is already established. conn is closed on error.
+func NewClientConnWithRawAddr(conn net.Conn, rawaddr []byte, encryptConfig ClientEncryptConfig) (c *Conn, err error) {
     if c, err = NewClientConn(conn, encryptConfig); err != nil {
+        conn.Close()
         return
     }
     if err = c.HandShake(); err != nil {
-        return
+        c.Close()
+        return nil, err
     }
     if _, err = c.Write(rawaddr); err != nil {
         c.Close()
         return nil, err
     }
+    if c.extensions&ExtConnectStatus != 0 {
+        if err = c.readConnectStatus(); err != nil {
+            c.Close()
+            return nil, err
+        }
+    }
     return
 }
 
+// readConnectStatus waits for the server connecting to the destination, and
+// returns the typed error of the status. If the server doesn't acknowledge the
+// extension, the extension is off and the data read is kept for Read.
+func (c *Conn) readConnectStatus() error {
+    ack := append(append([]byte(nil), connectStatusAck...), c.extensions)
+    buf := make([]byte, len(ack))
+    for i := range ack {
+        if _, err := io.ReadFull(c, buf[i:i+1]); err != nil {
+            if i > 0 && err == io.EOF {
+                c.pending = buf[:i]
+                c.extensions = 0
+                return nil
+            }
+            return err
+        }
+        if buf[i] != ack[i] {
+            c.pending = buf[:i+1]
+            c.extensions = 0
+            return nil
+        }
+    }
+    status := make([]byte, 1)
+    if _, err := io.ReadFull(c, status); err != nil {
+        return err
+    }
+    if status[0] == ConnectStatusSuccess {
+        return nil
+    }
+    if err, ok := connectStatusErrors[status[0]]; ok {
+        return err
+    }
+    return ErrConnectFailed
+}
+
+// WriteConnectStatus sends the status of connecting to the destination, if
+// the client requested it with ExtConnectStatus. It's a no-op otherwise.
+func (c *Conn) WriteConnectStatus(status byte) error {
+    if c.extensions&ExtConnectStatus == 0 {
+        return nil
+    }
+    buf := append(append([]byte(nil), connectStatusAck...), c.extensions, status)
+    _, err := c.Write(buf)
+    return err
+}
+
+// Extensions returns the protocol extensions in use.
+func (c *Conn) Extensions() byte {
+    return c.extensions
+}
+
 // addr should be in the form of host:port
 func Dial(addr, server string, encryptConfig ClientEncryptConfig) (c *Conn, err error) {
     ra, err := RawAddr(addr)
@@ -112,12 +250,35 @@ func Dial(addr, server string, encryptConfig ClientEncryptConfig) (c *Conn, err
     return DialWithRawAddr(ra, server, encryptConfig)
 }
 
+// DialTimeout is like Dial, but with a timeout as DialWithRawAddrTimeout.
+func DialTimeout(addr, server string, encryptConfig ClientEncryptConfig, timeout time.Duration) (c *Conn, err error) {
+    ra, err := RawAddr(addr)
+    if err != nil {
+        return
+    }
+    return DialWithRawAddrTimeout(ra, server, encryptConfig, timeout)
+}
+
+// Token returns the token which the connection is authenticated with.
+func (c *Conn) Token() string {
+    if c.clientEncryptConfig != nil {
+        token, _ := c.clientEncryptConfig.GetToken()
+        return token
+    }
+    return c.token
+}
+
 func (c *Conn) Close() error {
     leakyBuf.Put(c.readBuf)
-    leakyBuf.Put(c.writeBuf)
+    putBuf(c.writeBuf)
     return c.Conn.Close()
 }
 
+// CloseWrite shuts down the writing side of the underlying connection.
+func (c *Conn) CloseWrite() error {
+    return CloseWrite(c.Conn)
+}
+
 func (c *Conn) initBodyCipher(method, tokenSecret string)(err error) {
     c.bodyCipher, err = NewCipher(method, tokenSecret)
     if err != nil {
@@ -164,12 +325,16 @@ func (c *Conn) HandShake() (err error) {
             i := bytes.IndexByte(decryptBuf, 0)
             if i != -1 {
                 token = string(decryptBuf[:i])
+                if i < TOKEN_SIZE-1 {
+                    c.extensions = decryptBuf[TOKEN_SIZE-1] & supportedExtensions
+                }
             } else {
                 token = string(decryptBuf)
             }
         }
 
         c.headerCipher = nil
+        c.token = token
 
         var tokenSecret string
         tokenSecret, err = c.serverEncryptConfig.GetTokenSecret(token)
@@ -185,6 +350,12 @@ func (c *Conn) HandShake() (err error) {
         if len(token) > TOKEN_SIZE {
             return errors.New("Wrong token length")
         }
+        if ext, ok := c.clientEncryptConfig.(ExtendedClientEncryptConfig); ok {
+            c.extensions = ext.GetExtensions()
+        }
+        if c.extensions != 0 && len(token) > TOKEN_SIZE-2 {
+            return errTokenTooLongForExt
+        }
         var iv []byte
         iv, err = c.headerCipher.initEncrypt()
         if err != nil {
@@ -201,6 +372,9 @@ func (c *Conn) HandShake() (err error) {
             paddingLen := TOKEN_SIZE - len(token)
             copy(tokenBytes[len(token):], bytes.Repeat([]byte{byte(0)}, paddingLen))
         }
+        if c.extensions != 0 {
+            tokenBytes[TOKEN_SIZE-1] = c.extensions
+        }
 
         c.headerCipher.encrypt(cipherData[len(iv):], tokenBytes)
         _, err = c.Conn.Write(cipherData)
@@ -216,30 +390,40 @@ func (c *Conn) HandShake() (err error) {
 }
 
 func (c *Conn) Read(b []byte) (n int, err error) {
-    cipherData := c.readBuf
-    if len(b) > len(cipherData) {
-        cipherData = make([]byte, len(b))
-    } else {
-        cipherData = cipherData[:len(b)]
+    if len(c.pending) > 0 {
+        n = copy(b, c.pending)
+        c.pending = c.pending[n:]
+        return
     }
-
-    n, err = c.Conn.Read(cipherData)
+    // Decrypt in place, which the stream ciphers allow as long as dst and
+    // src overlap entirely.
+    n, err = c.Conn.Read(b)
     if n > 0 {
-        c.bodyCipher.decrypt(b[0:n], cipherData[0:n])
+        c.bodyCipher.decrypt(b[0:n], b[0:n])
     }
     return
 }
 
 func (c *Conn) Write(b []byte) (n int, err error) {
-    cipherData := c.writeBuf
-    dataSize := len(b)
-    if dataSize > len(cipherData) {
-        cipherData = make([]byte, dataSize)
-    } else {
-        cipherData = cipherData[:dataSize]
+    if len(b) > len(c.writeBuf) && len(c.writeBuf) < largeBufSize {
+        // Bulk writes, switch to a large buffer rather than allocating.
+        leakyBuf.Put(c.writeBuf)
+        c.writeBuf = largeLeakyBuf.Get()
+    }
+    for len(b) > 0 {
+        size := len(b)
+        if size > len(c.writeBuf) {
+            size = len(c.writeBuf)
+        }
+        cipherData := c.writeBuf[:size]
+        c.bodyCipher.encrypt(cipherData, b[:size])
+        var nw int
+        nw, err = c.Conn.Write(cipherData)
+        n += nw
+        if err != nil {
+            return
+        }
+        b = b[size:]
     }
-
-    c.bodyCipher.encrypt(cipherData, b)
-    n, err = c.Conn.Write(cipherData)
     return
 }
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+type testEncryptConfig struct {
+	cipher *Cipher
+}
+
+func (c *testEncryptConfig) GetServerSecret() string  { return "shared_secret" }
+func (c *testEncryptConfig) GetEncryptMethod() string { return "aes-256-cfb" }
+func (c *testEncryptConfig) NewHeaderCipher() *Cipher { return c.cipher.Copy() }
+func (c *testEncryptConfig) GetToken() (string, string) {
+	return "charlie", "token_secret"
+}
+func (c *testEncryptConfig) GetTokenSecret(token string) (string, error) {
+	return "token_secret", nil
+}
+
+type testExtEncryptConfig struct {
+	testEncryptConfig
+	extensions byte
+}
+
+func (c *testExtEncryptConfig) GetExtensions() byte { return c.extensions }
+
+// dialPipe connects a client to a server over loopback, the server handshakes
+// and reads the address, then sends the status. A legacy server ignores the
+// extensions, as the servers which don't support them.
+func dialPipe(t *testing.T, extensions byte, status byte, legacy bool) (*Conn, byte, error) {
+	cipher, err := NewCipher("aes-256-cfb", "shared_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &testExtEncryptConfig{testEncryptConfig{cipher: cipher}, extensions}
+	rawaddr, _ := RawAddr("example.com:80")
+
+	// net.Pipe doesn't do as both sides write their IV before reading.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	clientSide, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSide, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverExt := make(chan byte, 1)
+	go func() {
+		defer serverSide.Close()
+		server, _ := NewServerConn(serverSide, config)
+		if err := server.HandShake(); err != nil {
+			serverExt <- 0xff
+			return
+		}
+		if legacy {
+			server.extensions = 0
+		}
+		serverExt <- server.Extensions()
+		buf := make([]byte, len(rawaddr))
+		if _, err := server.Read(buf); err != nil {
+			return
+		}
+		server.WriteConnectStatus(status)
+		server.Write([]byte("ok"))
+	}()
+	c, err := NewClientConnWithRawAddr(clientSide, rawaddr, config)
+	return c, <-serverExt, err
+}
+
+func TestConnectStatusSuccess(t *testing.T) {
+	c, ext, err := dialPipe(t, ExtConnectStatus, ConnectStatusSuccess, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ext != ExtConnectStatus {
+		t.Errorf("server extensions %v, want %v", ext, ExtConnectStatus)
+	}
+	buf := make([]byte, 2)
+	if _, err := c.Read(buf); err != nil || string(buf) != "ok" {
+		t.Errorf("read %q %v after status", buf, err)
+	}
+}
+
+func TestConnectStatusError(t *testing.T) {
+	_, _, err := dialPipe(t, ExtConnectStatus, ConnectStatusDenied, false)
+	if err != ErrConnectDenied {
+		t.Errorf("got error %v, want %v", err, ErrConnectDenied)
+	}
+}
+
+func TestConnectStatusNotNegotiated(t *testing.T) {
+	c, ext, err := dialPipe(t, 0, ConnectStatusDenied, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ext != 0 {
+		t.Errorf("server extensions %v, want 0", ext)
+	}
+	// No status is sent without the extension.
+	buf := make([]byte, 2)
+	if _, err := c.Read(buf); err != nil || string(buf) != "ok" {
+		t.Errorf("read %q %v", buf, err)
+	}
+}
+
+func TestConnectStatusNotAcknowledged(t *testing.T) {
+	c, _, err := dialPipe(t, ExtConnectStatus, ConnectStatusDenied, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Extensions() != 0 {
+		t.Errorf("extensions %v without acknowledgement, want 0", c.Extensions())
+	}
+	// The data read while looking for the status is kept.
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ok" {
+		t.Errorf("read %q %v", buf, err)
+	}
+}
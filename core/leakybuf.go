@@ -11,6 +11,18 @@ const maxNBuf = 2048
 
 var leakyBuf = NewLeakyBuf(maxNBuf, leakyBufSize)
 
+// Large buffers for bulk transfers, see largeBufSize.
+var largeLeakyBuf = NewLeakyBuf(maxNBuf/16, largeBufSize)
+
+// putBuf puts the buffer back to the leaky buffer of its size.
+func putBuf(b []byte) {
+	if len(b) == largeBufSize && largeBufSize != leakyBufSize {
+		largeLeakyBuf.Put(b)
+	} else {
+		leakyBuf.Put(b)
+	}
+}
+
 // NewLeakyBuf creates a leaky buffer which can hold at most n buffer, each
 // with bufSize bytes.
 func NewLeakyBuf(n, bufSize int) *LeakyBuf {
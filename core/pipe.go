@@ -1,36 +1,86 @@
 package core
 
 import (
-	// "io"
+	"errors"
+	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
-var readTimeout time.Duration = 300
+var (
+	ErrIdleTimeout   = errors.New("shadowsocks: idle timeout")
+	ErrLingerTimeout = errors.New("shadowsocks: linger timeout")
+	ErrRelayAborted  = errors.New("shadowsocks: relay aborted")
+)
 
-func SetReadTimeout(c net.Conn) {
-	if readTimeout != 0 {
-		c.SetReadDeadline(time.Now().Add(readTimeout))
-	}
+// IdleTimer tracks the last activity of a relay. It's shared by the two
+// directions, so that activity in either direction keeps both alive.
+type IdleTimer struct {
+	timeout    time.Duration
+	lastActive int64
+}
+
+func NewIdleTimer(timeout time.Duration) *IdleTimer {
+	t := &IdleTimer{timeout: timeout}
+	t.Touch()
+	return t
+}
+
+// Touch records activity at the current time.
+func (t *IdleTimer) Touch() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+}
+
+// Deadline returns the time the relay expires if there's no more activity.
+func (t *IdleTimer) Deadline() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.lastActive)).Add(t.timeout)
 }
 
 // PipeThenClose copies data from src to dst, closes dst when done.
-func PipeThenClose(src, dst net.Conn) {
+// It returns the number of bytes written to dst, and the error which stopped
+// the copy, or nil if src reached EOF.
+func PipeThenClose(src, dst net.Conn) (written int64, err error) {
+	return PipeThenCloseWithIdleTimer(src, dst, nil)
+}
+
+// PipeThenCloseWithIdleTimer is like PipeThenClose, but also stops with
+// ErrIdleTimeout when the timer expires. timer may be nil.
+func PipeThenCloseWithIdleTimer(src, dst net.Conn, timer *IdleTimer) (written int64, err error) {
 	defer dst.Close()
 	buf := leakyBuf.Get()
 	defer leakyBuf.Put(buf)
 	for {
-//		SetReadTimeout(src)
-		n, err := src.Read(buf)
+		if timer != nil {
+			src.SetReadDeadline(timer.Deadline())
+		}
+		n, rerr := src.Read(buf)
 		// read may return EOF with n > 0
 		// should always process n > 0 bytes before handling error
 		if n > 0 {
 			// Note: avoid overwrite err returned by Read.
-			if _, err := dst.Write(buf[0:n]); err != nil {
+			nw, werr := dst.Write(buf[0:n])
+			written += int64(nw)
+			if werr != nil {
+				err = werr
 				break
 			}
+			if timer != nil {
+				timer.Touch()
+			}
 		}
-		if err != nil {
+		if rerr != nil {
+			if ne, ok := rerr.(net.Error); ok && ne.Timeout() && timer != nil {
+				// The other direction may have been active meanwhile.
+				if time.Now().Before(timer.Deadline()) {
+					continue
+				}
+				err = ErrIdleTimeout
+				break
+			}
+			if rerr != io.EOF {
+				err = rerr
+			}
 			// Always "use of closed network connection", but no easy way to
 			// identify this specific error. So just leave the error along for now.
 			// More info here: https://code.google.com/p/go/issues/detail?id=4373
@@ -42,4 +92,299 @@ func PipeThenClose(src, dst net.Conn) {
 			break
 		}
 	}
+	return
+}
+
+// PipeResult describes one direction of a relay.
+type PipeResult struct {
+	// Bytes written to the destination.
+	Written int64
+	// The error which stopped the copy, nil if the source reached EOF.
+	Err error
+	End time.Time
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CloseWrite shuts down the writing side of the connection if it supports
+// half-close, or closes it completely otherwise.
+func CloseWrite(c net.Conn) error {
+	if cw, ok := c.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+type relay struct {
+	timer *IdleTimer
+	// An *IdleTimer started when either direction reaches EOF, the other one
+	// then stops once it's idle for the linger time.
+	linger  atomic.Value
+	aborted int32
+}
+
+func (r *relay) lingerTimer() *IdleTimer {
+	t, _ := r.linger.Load().(*IdleTimer)
+	return t
+}
+
+// deadline returns the time the relay expires if there's no more activity,
+// or the zero time if never.
+func (r *relay) deadline() (d time.Time) {
+	if r.timer != nil {
+		d = r.timer.Deadline()
+	}
+	if t := r.lingerTimer(); t != nil {
+		if ld := t.Deadline(); d.IsZero() || ld.Before(d) {
+			d = ld
+		}
+	}
+	return
+}
+
+// touch records activity on both the idle and the linger timers.
+func (r *relay) touch() {
+	if r.timer != nil {
+		r.timer.Touch()
+	}
+	if t := r.lingerTimer(); t != nil {
+		t.Touch()
+	}
+}
+
+// abort stops both directions by expiring the deadlines, the connections are
+// kept open until the pipes return so that their buffers are not reused.
+func (r *relay) abort(left, right net.Conn) {
+	atomic.StoreInt32(&r.aborted, 1)
+	now := time.Now()
+	left.SetDeadline(now)
+	right.SetDeadline(now)
+}
+
+func (r *relay) isAborted() bool {
+	return atomic.LoadInt32(&r.aborted) != 0
+}
+
+// setReadDeadline sets the read deadline of src by the timers. It's checked
+// after the deadline is set, so that it can't override the one set by abort,
+// or miss the linger timer started meanwhile.
+func (r *relay) setReadDeadline(src net.Conn) error {
+	for {
+		lingering := r.lingerTimer() != nil
+		src.SetReadDeadline(r.deadline())
+		if r.isAborted() {
+			return ErrRelayAborted
+		}
+		if lingering || r.lingerTimer() == nil {
+			return nil
+		}
+	}
+}
+
+// readError decides how a relay direction goes on after reading from src
+// fails, it returns whether to read again, and the error to stop with.
+func (r *relay) readError(err error) (retry bool, stopErr error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if r.isAborted() {
+			return false, ErrRelayAborted
+		}
+		if d := r.deadline(); !d.IsZero() {
+			// The other direction may have been active meanwhile, or the
+			// linger timer just started.
+			now := time.Now()
+			if now.Before(d) {
+				return true, nil
+			}
+			if t := r.lingerTimer(); t != nil && !now.Before(t.Deadline()) {
+				return false, ErrLingerTimeout
+			}
+			return false, ErrIdleTimeout
+		}
+	}
+	return false, err
+}
+
+// pipe copies data from src to dst, and half-closes dst when src reaches EOF.
+// If either side is a plain TCP connection, the copy is left to its ReadFrom
+// or WriteTo, which splice in the kernel on linux when both sides are.
+func (r *relay) pipe(src, dst net.Conn) *PipeResult {
+	_, srcTCP := src.(*net.TCPConn)
+	_, dstTCP := dst.(*net.TCPConn)
+	if srcTCP || dstTCP {
+		if rf, ok := dst.(io.ReaderFrom); ok {
+			return r.pipeReadFrom(src, dst, rf)
+		}
+		if wt, ok := src.(io.WriterTo); ok {
+			return r.pipeWriteTo(src, dst, wt)
+		}
+	}
+
+	result := &PipeResult{}
+	// Start with a small buffer, and switch to a large one once the reads
+	// keep filling it, which means a bulk transfer.
+	buf := leakyBuf.Get()
+	fullReads := 0
+	defer func() {
+		putBuf(buf)
+	}()
+	for {
+		if result.Err = r.setReadDeadline(src); result.Err != nil {
+			break
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			nw, werr := dst.Write(buf[0:n])
+			result.Written += int64(nw)
+			if werr != nil {
+				result.Err = werr
+				break
+			}
+			r.touch()
+			if n == len(buf) && len(buf) < largeBufSize {
+				if fullReads++; fullReads >= 4 {
+					putBuf(buf)
+					buf = largeLeakyBuf.Get()
+				}
+			}
+		}
+		if err != nil {
+			retry, stopErr := r.readError(err)
+			if retry {
+				continue
+			}
+			if stopErr == io.EOF {
+				CloseWrite(dst)
+			} else {
+				result.Err = stopErr
+			}
+			break
+		}
+	}
+	result.End = time.Now()
+	return result
+}
+
+// pipeReadFrom copies with the ReadFrom of dst. The copy is done in chunks to
+// keep the timers going.
+func (r *relay) pipeReadFrom(src, dst net.Conn, rf io.ReaderFrom) *PipeResult {
+	const chunkSize = 1024 * 1024
+
+	result := &PipeResult{}
+	for {
+		if result.Err = r.setReadDeadline(src); result.Err != nil {
+			break
+		}
+		n, err := rf.ReadFrom(&io.LimitedReader{R: src, N: chunkSize})
+		result.Written += n
+		if n > 0 {
+			r.touch()
+		}
+		if err != nil {
+			retry, stopErr := r.readError(err)
+			if retry {
+				continue
+			}
+			result.Err = stopErr
+			break
+		}
+		if n == 0 {
+			// ReadFrom returns no error at EOF.
+			CloseWrite(dst)
+			break
+		}
+	}
+	result.End = time.Now()
+	return result
+}
+
+// activityWriter writes to dst for WriteTo, which only returns at EOF, so
+// the timers and the read deadline of src are kept going on every write.
+type activityWriter struct {
+	r       *relay
+	src     net.Conn
+	dst     net.Conn
+	written int64
+}
+
+func (w *activityWriter) Write(b []byte) (int, error) {
+	n, err := w.dst.Write(b)
+	w.written += int64(n)
+	if n > 0 {
+		w.r.touch()
+		if derr := w.r.setReadDeadline(w.src); derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return n, err
+}
+
+// pipeWriteTo copies with the WriteTo of src.
+func (r *relay) pipeWriteTo(src, dst net.Conn, wt io.WriterTo) *PipeResult {
+	result := &PipeResult{}
+	w := &activityWriter{r: r, src: src, dst: dst}
+	for {
+		if result.Err = r.setReadDeadline(src); result.Err != nil {
+			break
+		}
+		_, err := wt.WriteTo(w)
+		if err == ErrRelayAborted {
+			result.Err = err
+			break
+		}
+		if err != nil {
+			retry, stopErr := r.readError(err)
+			if retry {
+				continue
+			}
+			result.Err = stopErr
+			break
+		}
+		// WriteTo returns no error at EOF.
+		CloseWrite(dst)
+		break
+	}
+	result.Written = w.written
+	result.End = time.Now()
+	return result
+}
+
+// Relay copies data between client and remote in both directions, and closes
+// both when done. Each direction is half-closed independently when its source
+// reaches EOF, after which the other direction stops once it's idle for the
+// linger time. An error in either direction stops both. timer may be nil.
+func Relay(client, remote net.Conn, timer *IdleTimer, linger time.Duration) (up, down *PipeResult) {
+	r := &relay{timer: timer}
+	upChan := make(chan *PipeResult, 1)
+	downChan := make(chan *PipeResult, 1)
+	go func() {
+		upChan <- r.pipe(client, remote)
+	}()
+	go func() {
+		downChan <- r.pipe(remote, client)
+	}()
+
+	// remaining is the source of the direction still going.
+	finish := func(result *PipeResult, remaining net.Conn) {
+		if result.Err != nil {
+			r.abort(client, remote)
+		} else {
+			r.linger.Store(NewIdleTimer(linger))
+			// Wake it up to pick the deadline of the linger timer.
+			remaining.SetReadDeadline(time.Now())
+		}
+	}
+	select {
+	case up = <-upChan:
+		finish(up, remote)
+		down = <-downChan
+	case down = <-downChan:
+		finish(down, client)
+		up = <-upChan
+	}
+
+	client.Close()
+	remote.Close()
+	return
 }
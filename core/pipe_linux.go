@@ -0,0 +1,5 @@
+package core
+
+// Size of the buffers for bulk transfers. Linux sockets take large writes
+// at once, which saves syscalls.
+const largeBufSize = 64 * 1024
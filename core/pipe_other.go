@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+// Size of the buffers for bulk transfers, the same as the small ones except
+// on linux.
+const largeBufSize = leakyBufSize
@@ -0,0 +1,126 @@
+//go:build linux
+// +build linux
+
+package core
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// sspPair handshakes ssp over the two ends of a connection.
+func sspPair(b *testing.B, clientSide, serverSide net.Conn) (*Conn, *Conn) {
+	cipher, err := NewCipher("aes-256-cfb", "shared_secret")
+	if err != nil {
+		b.Fatal(err)
+	}
+	config := &testEncryptConfig{cipher: cipher}
+	client, _ := NewClientConn(clientSide, config)
+	server, _ := NewServerConn(serverSide, config)
+	done := make(chan error)
+	go func() {
+		done <- server.HandShake()
+	}()
+	if err := client.HandShake(); err != nil {
+		b.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+	return client, server
+}
+
+// Which side of the pipe talks ssp, as the server does with its clients.
+const (
+	plainPipe = iota
+	// Uploads, from an ssp client to a plain destination.
+	encryptedSrc
+	// Downloads, from a plain destination to an ssp client.
+	encryptedDst
+)
+
+// benchmarkPipe sends b.N chunks from a sender through the pipe to a sink.
+// The CPU time includes the sender and the sink.
+func benchmarkPipe(b *testing.B, mode int, pipe func(src, dst net.Conn)) {
+	const chunkSize = 32 * 1024
+
+	sender, src := tcpPair(b)
+	dst, sink := tcpPair(b)
+	switch mode {
+	case encryptedSrc:
+		sender, src = sspPair(b, sender, src)
+	case encryptedDst:
+		sink, dst = sspPair(b, sink, dst)
+	}
+
+	received := make(chan int64)
+	go func() {
+		n, _ := io.Copy(io.Discard, sink)
+		sink.Close()
+		received <- n
+	}()
+
+	chunk := make([]byte, chunkSize)
+	b.SetBytes(chunkSize)
+	b.ResetTimer()
+	cpuStart := cpuTime()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := sender.Write(chunk); err != nil {
+				break
+			}
+		}
+		CloseWrite(sender)
+	}()
+	pipe(src, dst)
+	n := <-received
+	b.StopTimer()
+
+	if n != int64(b.N)*chunkSize {
+		b.Fatalf("received %d bytes, expected %d", n, int64(b.N)*chunkSize)
+	}
+	cpu := cpuTime() - cpuStart
+	b.ReportMetric(cpu.Seconds()/(float64(n)/1e9), "cpu-s/GB")
+	sender.Close()
+}
+
+func pipeThenClose(src, dst net.Conn) {
+	PipeThenClose(src, dst)
+}
+
+func relayBoth(src, dst net.Conn) {
+	Relay(src, dst, NewIdleTimer(time.Minute), time.Second)
+}
+
+func BenchmarkPipeThenCloseTCP(b *testing.B) {
+	benchmarkPipe(b, plainPipe, pipeThenClose)
+}
+
+func BenchmarkRelayTCP(b *testing.B) {
+	benchmarkPipe(b, plainPipe, relayBoth)
+}
+
+func BenchmarkPipeThenCloseEncrypted(b *testing.B) {
+	benchmarkPipe(b, encryptedSrc, pipeThenClose)
+}
+
+func BenchmarkRelayEncrypted(b *testing.B) {
+	benchmarkPipe(b, encryptedSrc, relayBoth)
+}
+
+func BenchmarkPipeThenCloseEncryptedDownload(b *testing.B) {
+	benchmarkPipe(b, encryptedDst, pipeThenClose)
+}
+
+func BenchmarkRelayEncryptedDownload(b *testing.B) {
+	benchmarkPipe(b, encryptedDst, relayBoth)
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a TCP connection over loopback.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c, <-accepted
+}
+
+type relayResult struct {
+	up, down *PipeResult
+}
+
+// wrappedConn hides the TCP connection, as ssplocal wraps its clients.
+type wrappedConn struct {
+	*net.TCPConn
+}
+
+// startRelay relays between a client and a remote over loopback, it returns
+// the application ends of both. With wrapped, the relay can't use the TCP
+// connection of the client, so it goes through WriteTo of the remote.
+func startRelay(t *testing.T, linger time.Duration, wrapped bool) (client, remote net.Conn, done chan relayResult) {
+	client, clientSide := tcpPair(t)
+	remoteSide, remote := tcpPair(t)
+	if wrapped {
+		clientSide = wrappedConn{clientSide.(*net.TCPConn)}
+	}
+	done = make(chan relayResult, 1)
+	go func() {
+		up, down := Relay(clientSide, remoteSide, nil, linger)
+		done <- relayResult{up, down}
+	}()
+	return
+}
+
+func TestRelayLingerSlowDownload(t *testing.T) {
+	testRelayLingerSlowDownload(t, false)
+	testRelayLingerSlowDownload(t, true)
+}
+
+func testRelayLingerSlowDownload(t *testing.T, wrapped bool) {
+	client, remote, done := startRelay(t, 100*time.Millisecond, wrapped)
+	defer client.Close()
+	defer remote.Close()
+
+	// A client which half-closes after the request, like HTTP/1.0.
+	client.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	CloseWrite(client)
+	go func() {
+		io.Copy(io.Discard, remote)
+		chunk := make([]byte, 100)
+		for i := 0; i < 30; i++ {
+			remote.Write(chunk)
+			time.Sleep(10 * time.Millisecond)
+		}
+		remote.Close()
+	}()
+
+	n, err := io.Copy(io.Discard, client)
+	if err != nil || n != 3000 {
+		t.Fatalf("received %d bytes with %v, want 3000, wrapped %v", n, err, wrapped)
+	}
+	result := <-done
+	if result.up.Err != nil || result.down.Err != nil {
+		t.Errorf("relay errors %v, %v", result.up.Err, result.down.Err)
+	}
+}
+
+func TestRelayLingerIdle(t *testing.T) {
+	client, remote, done := startRelay(t, 100*time.Millisecond, true)
+	defer client.Close()
+	defer remote.Close()
+
+	CloseWrite(client)
+	// The remote never answers.
+	select {
+	case result := <-done:
+		if result.down.Err != ErrLingerTimeout {
+			t.Errorf("down error %v, want %v", result.down.Err, ErrLingerTimeout)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay didn't stop after the linger time")
+	}
+}